@@ -0,0 +1,165 @@
+// Package geo looks up client IPs in local databases of MaxMind DB format, like GeoLite2 country, city and ASN ones.
+package geo
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// DB is a database file loaded into memory, which is reloaded once the file changes. Safe for concurrent use.
+type DB struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time // modification time of the loaded file
+	size    int64     // size of the loaded file
+}
+
+// Open loads database from the file
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload loads the database file again if its modification time or size changed since the last load.
+// Returns true if the database was reloaded. Previously loaded database is kept on error.
+func (d *DB) Reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+	d.mu.RLock()
+	unchanged := d.reader != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size
+	d.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// database is read into memory instead of mapping the file, as the file can be replaced while lookups are running
+	buf, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := maxminddb.OpenBytes(buf)
+	if err != nil {
+		return false, fmt.Errorf("can't load %s: %w", d.path, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reader, d.modTime, d.size = reader, info.ModTime(), info.Size()
+	return true, nil
+}
+
+// RunReload reloads the database every interval until ctx is cancelled
+func (d *DB) RunReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := d.Reload()
+		if err != nil {
+			log.Printf("[WARN] can't reload %s, %v", d.path, err)
+			continue
+		}
+		if reloaded {
+			log.Printf("[INFO] reloaded %s, %s", d.path, d.Metadata().DatabaseType)
+		}
+	}
+}
+
+// Metadata returns metadata of the loaded database
+func (d *DB) Metadata() maxminddb.Metadata {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.reader.Metadata
+}
+
+// lookup decodes record of the network containing ip into rec, which is left unchanged if ip is not in the database
+func (d *DB) lookup(ip string, rec any) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	d.mu.RLock()
+	reader := d.reader
+	d.mu.RUnlock()
+	return reader.Lookup(addr.WithZone("")).Decode(rec)
+}
+
+// Location is a country and a region of IP address
+type Location struct {
+	Country string // ISO 3166-1 country code, like US
+	Region  string // ISO 3166-2 code of the first level subdivision, like US-CA, empty if unknown
+}
+
+// locationRecord is a part of country and city database record with location codes
+type locationRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// Location returns location of ip from country or city database. Location is empty if ip is not in the database,
+// and country is the registered one if the actual country is unknown.
+func (d *DB) Location(ip string) (Location, error) {
+	var rec locationRecord
+	if err := d.lookup(ip, &rec); err != nil {
+		return Location{}, err
+	}
+	res := Location{Country: rec.Country.ISOCode}
+	if res.Country == "" {
+		res.Country = rec.RegisteredCountry.ISOCode
+	}
+	if len(rec.Subdivisions) > 0 && rec.Subdivisions[0].ISOCode != "" && res.Country != "" {
+		res.Region = res.Country + "-" + rec.Subdivisions[0].ISOCode
+	}
+	return res, nil
+}
+
+// ASN is an autonomous system, a network operated by a single ISP or hosting provider
+type ASN struct {
+	Number       uint64
+	Organization string
+}
+
+// String returns "AS<number> <organization>", empty string for unknown autonomous system
+func (a ASN) String() string {
+	if a.Number == 0 {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("AS%d %s", a.Number, a.Organization))
+}
+
+// ASN returns autonomous system of ip from ASN database, zero ASN if ip is not in the database
+func (d *DB) ASN(ip string) (ASN, error) {
+	var rec struct {
+		Number       uint64 `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
+	if err := d.lookup(ip, &rec); err != nil {
+		return ASN{}, err
+	}
+	return ASN{Number: rec.Number, Organization: rec.Organization}, nil
+}
@@ -0,0 +1,118 @@
+package geo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Location(t *testing.T) {
+	country, err := Open("testdata/GeoIP2-Country-Test.mmdb")
+	require.NoError(t, err)
+	assert.Equal(t, "GeoIP2-Country", country.Metadata().DatabaseType)
+	city, err := Open("testdata/GeoIP2-City-Test.mmdb")
+	require.NoError(t, err)
+	assert.Equal(t, "GeoIP2-City", city.Metadata().DatabaseType)
+
+	tbl := []struct {
+		ip            string
+		country, city Location
+	}{
+		{"81.2.69.160", Location{Country: "GB"}, Location{Country: "GB", Region: "GB-ENG"}},
+		{"216.160.83.56", Location{Country: "US"}, Location{Country: "US", Region: "US-WA"}},
+		{"89.160.20.128", Location{Country: "SE"}, Location{Country: "SE", Region: "SE-E"}},
+		{"::ffff:81.2.69.160", Location{Country: "GB"}, Location{Country: "GB", Region: "GB-ENG"}},
+		{"2001:218::1", Location{Country: "JP"}, Location{Country: "JP"}},
+		{"2001:220::1%eth0", Location{Country: "KR"}, Location{Country: "KR"}},
+		{"214.1.1.1", Location{}, Location{}},
+		{"10.0.0.1", Location{}, Location{}},
+		{"127.0.0.1", Location{}, Location{}},
+	}
+	for _, tt := range tbl {
+		loc, err := country.Location(tt.ip)
+		require.NoError(t, err, tt.ip)
+		assert.Equal(t, tt.country, loc, tt.ip)
+		loc, err = city.Location(tt.ip)
+		require.NoError(t, err, tt.ip)
+		assert.Equal(t, tt.city, loc, tt.ip)
+	}
+	_, err = country.Location("bad")
+	assert.Error(t, err)
+}
+
+func TestDB_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	_, err := Open(path)
+	assert.Error(t, err, "no file")
+
+	copyFile(t, "testdata/GeoIP2-Country-Test.mmdb", path)
+	db, err := Open(path)
+	require.NoError(t, err)
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "file not changed")
+	loc, err := db.Location("81.2.69.160")
+	require.NoError(t, err)
+	assert.Equal(t, Location{Country: "GB"}, loc)
+
+	copyFile(t, "testdata/GeoIP2-City-Test.mmdb", path)
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	reloaded, err = db.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "GeoIP2-City", db.Metadata().DatabaseType)
+	loc, err = db.Location("81.2.69.160")
+	require.NoError(t, err)
+	assert.Equal(t, Location{Country: "GB", Region: "GB-ENG"}, loc)
+
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0o600))
+	_, err = db.Reload()
+	assert.Error(t, err)
+	loc, err = db.Location("81.2.69.160")
+	require.NoError(t, err)
+	assert.Equal(t, Location{Country: "GB", Region: "GB-ENG"}, loc, "previous database kept")
+}
+
+func TestDB_ASN(t *testing.T) {
+	db, err := Open("testdata/GeoLite2-ASN-Test.mmdb")
+	require.NoError(t, err)
+	assert.Equal(t, "GeoLite2-ASN", db.Metadata().DatabaseType)
+
+	tbl := []struct {
+		ip  string
+		res ASN
+		str string
+	}{
+		{"1.0.0.1", ASN{Number: 15169, Organization: "Google Inc."}, "AS15169 Google Inc."},
+		{"1.128.0.0", ASN{Number: 1221, Organization: "Telstra Pty Ltd"}, "AS1221 Telstra Pty Ltd"},
+		{"12.81.96.1", ASN{Number: 7018}, "AS7018"},
+		{"10.0.0.1", ASN{}, ""},
+	}
+	for _, tt := range tbl {
+		asn, err := db.ASN(tt.ip)
+		require.NoError(t, err, tt.ip)
+		assert.Equal(t, tt.res, asn, tt.ip)
+		assert.Equal(t, tt.str, asn.String(), tt.ip)
+	}
+
+	country, err := Open("testdata/GeoIP2-Country-Test.mmdb")
+	require.NoError(t, err)
+	asn, err := country.ASN("81.2.69.160")
+	require.NoError(t, err)
+	assert.Equal(t, ASN{}, asn, "not an ASN record")
+
+	_, err = db.ASN("bad")
+	assert.Error(t, err)
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	buf, err := os.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, buf, 0o600))
+}
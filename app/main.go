@@ -4,21 +4,50 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
 	"github.com/jessevdk/go-flags"
 
+	"github.com/umputun/rlb-stats/app/geo"
 	"github.com/umputun/rlb-stats/app/store"
 	"github.com/umputun/rlb-stats/app/web"
 )
 
 type opts struct {
-	BoltDB string `long:"bolt" env:"BOLT_FILE" default:"/tmp/rlb-stats.bd" description:"boltdb file path"`
-	Port   int    `long:"port" env:"PORT" default:"8080" description:"Web server port"`
-	Dbg    bool   `long:"dbg" env:"DEBUG" description:"debug mode"`
+	BoltDB        string        `long:"bolt" env:"BOLT_FILE" default:"/tmp/rlb-stats.bd" description:"boltdb file path"`
+	Port          int           `long:"port" env:"PORT" default:"8080" description:"Web server port"`
+	Window        time.Duration `long:"window" env:"WINDOW" default:"1m" description:"how long minutes stay open for out-of-order records"`
+	Lateness      time.Duration `long:"lateness" env:"LATENESS" default:"15m" description:"max lateness of records merged into stored minutes"`
+	FlushInterval time.Duration `long:"flush-interval" env:"FLUSH_INTERVAL" default:"10s" description:"how often to flush ended minutes, 0 to disable"`
+	FlushGrace    time.Duration `long:"flush-grace" env:"FLUSH_GRACE" default:"10s" description:"wait for records after minute end before flushing"`
+	NodeFiles     int           `long:"node-files" env:"NODE_FILES" default:"0" description:"files to keep per node in each candle, 0 to count files for all nodes together only"`
+	Listeners     bool          `long:"listeners" env:"LISTENERS" description:"collect sketches of client IPs to estimate unique listeners"`
+	DedupWindow   time.Duration `long:"dedup-window" env:"DEDUP_WINDOW" default:"0" description:"count single download per client IP and file within the window, up to 24h, 0 to deduplicate within a minute only"`
+	DedupKeys     int           `long:"dedup-keys" env:"DEDUP_KEYS" default:"1000000" description:"max client IP and file pairs kept for dedup-window, the oldest are forgotten first"`
+	MetricsFiles  int           `long:"metrics-files" env:"METRICS_FILES" default:"100" description:"max files with separate download counters in metrics"`
+	InsertTokens  []string      `long:"insert-token" env:"INSERT_TOKENS" env-delim:"," description:"node:token allowed to insert records of the node, insert is open if not set"`
+	InsertHMAC    bool          `long:"insert-hmac" env:"INSERT_HMAC" description:"require insert bodies signed with HMAC of the node token"`
+	InsertSkew    time.Duration `long:"insert-skew" env:"INSERT_SKEW" default:"5m" description:"max clock skew of signed insert requests"`
+	Privacy       string        `long:"privacy" env:"PRIVACY" default:"none" choice:"none" choice:"truncate" choice:"hash" description:"anonymize client IPs of inserted records"`
+	PrivacyIPv4   int           `long:"privacy-ipv4-prefix" env:"PRIVACY_IPV4_PREFIX" default:"24" description:"bits of IPv4 address kept with truncate privacy"`
+	PrivacyIPv6   int           `long:"privacy-ipv6-prefix" env:"PRIVACY_IPV6_PREFIX" default:"48" description:"bits of IPv6 address kept with truncate privacy"`
+	GeoIP         string        `long:"geoip" env:"GEOIP_DB" description:"MaxMind DB format country or city database to locate client IPs"`
+	ASNDB         string        `long:"asn-db" env:"ASN_DB" description:"MaxMind DB format ASN database to find autonomous systems of client IPs"`
+	ASNLimit      int           `long:"asn-limit" env:"ASN_LIMIT" default:"20" description:"autonomous systems to keep in each candle, 0 to keep all"`
+	GeoIPReload   time.Duration `long:"geoip-reload" env:"GEOIP_RELOAD" default:"1m" description:"how often to check geoip and asn databases for changes"`
+	MinuteDays    int           `long:"retention-minute" env:"RETENTION_MINUTE" default:"0" description:"days to keep minute candles, 0 to keep forever"`
+	HourDays      int           `long:"retention-hour" env:"RETENTION_HOUR" default:"0" description:"days to keep hourly candles, 0 to keep forever"`
+	DayDays       int           `long:"retention-day" env:"RETENTION_DAY" default:"0" description:"days to keep daily candles, 0 to keep forever"`
+	CompactEvery  time.Duration `long:"compact-interval" env:"COMPACT_INTERVAL" default:"1h" description:"how often to run compaction"`
+	Dbg           bool          `long:"dbg" env:"DEBUG" description:"debug mode"`
 }
 
+// dedupSaveInterval is how often deduplication keys are saved to survive restarts
+const dedupSaveInterval = time.Minute
+
 var revision string
 
 func main() {
@@ -37,26 +66,103 @@ func main() {
 	}
 	log.Printf("rlb-stats %s", revision)
 
+	if opts.DedupWindow < 0 || opts.DedupWindow > 24*time.Hour {
+		log.Fatalf("[ERROR] dedup-window should be between 0 and 24h, got %v", opts.DedupWindow)
+	}
+
 	storage := getEngine(opts.BoltDB)
-	aggregator := &store.Aggregator{}
+	storage.NodeFiles = opts.NodeFiles
+	storage.ASNs = opts.ASNLimit
+	aggregator := &store.Aggregator{Window: opts.Window, Lateness: opts.Lateness, NodeFiles: opts.NodeFiles > 0,
+		Listeners: opts.Listeners, DedupWindow: opts.DedupWindow, DedupLimit: opts.DedupKeys}
+	if opts.DedupWindow > 0 {
+		keys, err := storage.LoadDedup(time.Now().Add(-opts.DedupWindow))
+		if err != nil {
+			log.Fatalf("[ERROR] can't load deduplication keys, %v", err)
+		}
+		aggregator.RestoreDedup(keys)
+		log.Printf("[INFO] deduplication window %v, restored %d keys", opts.DedupWindow, len(keys))
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	webServer := web.Server{
-		Engine:     storage,
-		Aggregator: aggregator,
-		Port:       opts.Port,
-		Version:    revision,
+		Engine:        storage,
+		Aggregator:    aggregator,
+		Port:          opts.Port,
+		Version:       revision,
+		FlushInterval: opts.FlushInterval,
+		FlushGrace:    opts.FlushGrace,
+		MetricsFiles:  opts.MetricsFiles,
+	}
+	if opts.InsertHMAC && len(opts.InsertTokens) == 0 {
+		log.Fatalf("[ERROR] insert-hmac requires insert-token")
+	}
+	if len(opts.InsertTokens) > 0 {
+		auth, err := web.NewInsertAuth(opts.InsertTokens, opts.InsertHMAC, opts.InsertSkew)
+		if err != nil {
+			log.Fatalf("[ERROR] can't set insert authentication, %v", err)
+		}
+		webServer.InsertAuth = auth
+	}
+	if opts.Privacy != "none" {
+		privacy, err := web.NewPrivacy(opts.Privacy, opts.PrivacyIPv4, opts.PrivacyIPv6)
+		if err != nil {
+			log.Fatalf("[ERROR] can't set privacy, %v", err)
+		}
+		webServer.Privacy = privacy
+		log.Printf("[INFO] client IPs anonymized with %s privacy", opts.Privacy)
+		if opts.Privacy == "hash" && opts.Listeners {
+			log.Printf("[WARN] hashes of client IPs change daily and on restart, unique listeners of longer periods " +
+				"count a client once per day")
+		}
+	}
+	var wg sync.WaitGroup
+	if opts.GeoIP != "" {
+		db, err := geo.Open(opts.GeoIP)
+		if err != nil {
+			log.Fatalf("[ERROR] can't open geoip database, %v", err)
+		}
+		log.Printf("[INFO] client IPs located with %s, %s", opts.GeoIP, db.Metadata().DatabaseType)
+		webServer.Geo = db
+		wg.Go(func() { db.RunReload(ctx, opts.GeoIPReload) })
 	}
+	if opts.ASNDB != "" {
+		db, err := geo.Open(opts.ASNDB)
+		if err != nil {
+			log.Fatalf("[ERROR] can't open asn database, %v", err)
+		}
+		log.Printf("[INFO] client IP networks found with %s, %s", opts.ASNDB, db.Metadata().DatabaseType)
+		webServer.ASN = db
+		wg.Go(func() { db.RunReload(ctx, opts.GeoIPReload) })
+	}
+	if opts.MinuteDays > 0 || opts.HourDays > 0 || opts.DayDays > 0 {
+		retention := store.Retention{
+			Minute: time.Duration(opts.MinuteDays) * 24 * time.Hour,
+			Hour:   time.Duration(opts.HourDays) * 24 * time.Hour,
+			Day:    time.Duration(opts.DayDays) * 24 * time.Hour,
+		}
+		wg.Go(func() { storage.RunCompaction(ctx, opts.CompactEvery, retention) })
+	}
+	if opts.DedupWindow > 0 {
+		wg.Go(func() { saveDedup(ctx, storage, aggregator, opts.DedupWindow) })
+	}
+
 	webServer.Run(ctx)
+	wg.Wait()
 
 	// shutdown sequence: flush aggregator and close storage
-	if candle, ok := aggregator.Flush(); ok {
+	for _, candle := range aggregator.Flush() {
 		if err := storage.Save(candle); err != nil {
 			log.Printf("[WARN] failed to save flushed candle, %s", err)
-		} else {
-			log.Printf("[INFO] flushed aggregator candle on shutdown")
+			continue
+		}
+		log.Printf("[INFO] flushed aggregator candle for %v on shutdown", candle.StartMinute)
+	}
+	if opts.DedupWindow > 0 {
+		if err := storage.SaveDedup(aggregator.NewDedupKeys(), time.Now().Add(-opts.DedupWindow)); err != nil {
+			log.Printf("[WARN] failed to save deduplication keys, %s", err)
 		}
 	}
 	if err := storage.Close(); err != nil {
@@ -72,3 +178,20 @@ func getEngine(boltFile string) *store.Bolt {
 	}
 	return storage
 }
+
+// saveDedup saves deduplication keys counted by the aggregator since the previous save, and removes stored keys
+// older than window, every dedupSaveInterval until ctx is cancelled
+func saveDedup(ctx context.Context, storage *store.Bolt, aggregator *store.Aggregator, window time.Duration) {
+	ticker := time.NewTicker(dedupSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := storage.SaveDedup(aggregator.NewDedupKeys(), time.Now().Add(-window)); err != nil {
+			log.Printf("[WARN] failed to save deduplication keys, %s", err)
+		}
+	}
+}
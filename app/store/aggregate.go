@@ -1,61 +1,236 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
-// Aggregator stores single log records into minute candles, returning candle for previous minute when
-// first log entry for new minute appears
+// ErrTooLate returned by Aggregator.Store for records older than allowed lateness
+var ErrTooLate = errors.New("log record is too late")
+
+// ErrTooEarly returned by Aggregator.Store for records dated too far ahead of the current time
+var ErrTooEarly = errors.New("log record is from the future")
+
+// Aggregator stores single log records into minute candles. Minutes are kept open for Window
+// after the latest seen minute to let out-of-order records land into the right candle, and
+// emitted once they fall out of it. Records for already emitted minutes, up to Lateness after
+// the latest seen minute, are collected into separate candles per minute which have to be merged with stored ones.
+// Late candles are emitted on the next flush, or once the window moves and emits another minute, so a stream
+// of late records doesn't cost a storage write per record.
+// Records dated later than Window, or a minute if Window is shorter, after the current time are rejected,
+// so a node with a bad clock can't move the latest seen minute ahead and make all other records late.
+// With DedupWindow set, downloads of the same file by the same client IP are counted once within the window,
+// while all records are counted as raw requests.
+// Safe for concurrent use.
 type Aggregator struct {
-	entries []LogRecord // used to store entries which are not yet dumped into candles
+	Window      time.Duration // how long minutes stay open after the latest seen minute
+	Lateness    time.Duration // max age of accepted record relative to the latest seen minute
+	NodeFiles   bool          // count files per node besides "all" node
+	Listeners   bool          // collect sketches of client IPs to estimate unique listeners
+	DedupWindow time.Duration // count single download per client IP and file within the window, zero for a minute
+	DedupLimit  int           // max client IP and file pairs kept for DedupWindow, the oldest are forgotten first
+
+	mu      sync.Mutex
+	started bool                          // set after the first record stored
+	latest  time.Time                     // latest seen minute
+	open    map[int64]*minuteBucket       // minutes not yet emitted, by unix time
+	closed  map[int64]map[string]struct{} // deduplication keys of emitted minutes, by unix time
+	late    map[int64]*Candle             // late records of emitted minutes, not yet emitted, by unix time
+	dedup   dedupSet                      // downloads counted within DedupWindow
+}
+
+// minuteBucket collects records of a single open minute
+type minuteBucket struct {
+	candle Candle
+	seen   map[string]struct{} // deduplicate store ip-file map
 }
 
-// Store LogRecord into temp storage and return Candle when minute change,
-// counting multiple entries with same FromIP and FileName as single data point
-func (p *Aggregator) Store(entry LogRecord) (minuteCandle Candle, ok bool) {
+// Store LogRecord into temp storage and return Candles for minutes which went out of the window,
+// with candles of late records collected for already emitted minutes if there are any.
+// Multiple entries with same FromIP and FileName within a minute, or within DedupWindow if set,
+// are counted as single data point.
+func (p *Aggregator) Store(entry LogRecord) (candles []Candle, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.open == nil {
+		p.open = map[int64]*minuteBucket{}
+		p.closed = map[int64]map[string]struct{}{}
+		p.late = map[int64]*Candle{}
+	}
 
 	// drop seconds and nanoseconds from log date to match candle's 1min resolution
 	entry.Date = time.Date(entry.Date.Year(), entry.Date.Month(), entry.Date.Day(), entry.Date.Hour(), entry.Date.Minute(),
 		0, 0, entry.Date.Location())
 
-	// if there are existing entries and date changed
-	if len(p.entries) != 0 && !entry.Date.Equal(p.entries[len(p.entries)-1].Date) {
-		// then all previous entries have same date precise to the minute and will be written to single candle
-		minuteCandle = NewCandle()
-		var deduplicate = map[string]struct{}{} // deduplicate store ip-file map
-		for _, entry := range p.entries {
-			if _, dup := deduplicate[fmt.Sprintf("%s-%s", entry.FileName, entry.FromIP)]; dup {
-				continue
+	if entry.Date.After(time.Now().Add(max(p.Window, time.Minute))) {
+		return nil, ErrTooEarly
+	}
+	if !p.started || entry.Date.After(p.latest) {
+		p.latest, p.started = entry.Date, true
+	}
+	if entry.Date.Before(p.latest.Add(-p.horizon())) {
+		return nil, ErrTooLate
+	}
+
+	minute := entry.Date.Unix()
+	key := fmt.Sprintf("%s-%s", entry.FileName, entry.FromIP)
+	switch bucket, isOpen := p.open[minute]; {
+	case isOpen:
+		_, dup := bucket.seen[key]
+		p.update(&bucket.candle, entry, !dup)
+		bucket.seen[key] = struct{}{}
+	case !entry.Date.Before(p.latest.Add(-p.Window)) && p.closed[minute] == nil:
+		bucket = &minuteBucket{candle: NewCandle(), seen: map[string]struct{}{key: {}}}
+		p.update(&bucket.candle, entry, true)
+		p.open[minute] = bucket
+	default: // minute was already emitted, or is out of the window
+		seen, ok := p.closed[minute]
+		if !ok {
+			seen = map[string]struct{}{}
+			p.closed[minute] = seen
+		}
+		if _, dup := seen[key]; !dup || p.DedupWindow > 0 { // duplicates are still counted as raw requests
+			lateCandle, ok := p.late[minute]
+			if !ok {
+				c := NewCandle()
+				lateCandle = &c
+				p.late[minute] = lateCandle
 			}
-			minuteCandle.Update(entry)
-			deduplicate[fmt.Sprintf("%s-%s", entry.FileName, entry.FromIP)] = struct{}{}
+			p.update(lateCandle, entry, !dup)
+			seen[key] = struct{}{}
+		}
+	}
+
+	candles = append(candles, p.closeBefore(p.latest.Add(-p.Window), false)...)
+
+	// forget deduplication keys of minutes which can't receive records anymore
+	for m := range p.closed {
+		if time.Unix(m, 0).Before(p.latest.Add(-p.horizon())) {
+			delete(p.closed, m)
 		}
-		ok = true                 // candle is ready to be written
-		p.entries = []LogRecord{} // clean written entries
 	}
+	if p.DedupWindow > 0 {
+		p.dedup.expire(p.latest.Add(-p.horizon() - p.DedupWindow))
+		p.dedup.limit(p.DedupLimit)
+	}
+	return candles, nil
+}
 
-	p.entries = append(p.entries, entry)
-	return minuteCandle, ok
+// NewDedupKeys returns client IP and file pairs counted within DedupWindow since the previous call, or since
+// RestoreDedup, ordered by time of counting, so they can be saved incrementally
+func (p *Aggregator) NewDedupKeys() []DedupKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dedup.added()
 }
 
-// Flush emits a candle from any buffered entries without waiting for a minute boundary.
-// returns false if no entries are buffered.
-func (p *Aggregator) Flush() (minuteCandle Candle, ok bool) {
-	if len(p.entries) == 0 {
-		return Candle{}, false
+// RestoreDedup adds client IP and file pairs counted before, usually saved on the previous run,
+// so downloads counted then are not counted again within DedupWindow
+func (p *Aggregator) RestoreDedup(keys []DedupKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range keys {
+		p.dedup.add(dedupID{ip: k.FromIP, file: k.FileName}, k.Counted, p.DedupWindow)
 	}
+	p.dedup.limit(p.DedupLimit)
+	p.dedup.unsaved = 0 // restored pairs are saved already
+}
+
+// Flush emits candles from all open minutes without waiting for them to leave the window,
+// and collected late candles. Records arriving later for flushed minutes are emitted as late candles.
+func (p *Aggregator) Flush() []Candle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closeBefore(p.latest.Add(time.Minute), true) // open minutes can't be later than the latest one
+}
+
+// FlushBefore emits candles of open minutes started before given time, used to write minutes
+// which already ended by wall clock without waiting for records of the next minutes, and collected late candles.
+// Records arriving later for flushed minutes are emitted as late candles.
+func (p *Aggregator) FlushBefore(t time.Time) []Candle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closeBefore(t, true)
+}
 
-	minuteCandle = NewCandle()
-	deduplicate := map[string]struct{}{}
-	for _, entry := range p.entries {
-		key := fmt.Sprintf("%s-%s", entry.FileName, entry.FromIP)
-		if _, dup := deduplicate[key]; dup {
+// closeBefore emits open minutes started before given time, and collected late candles if any minute
+// is emitted or withLate is set, ordered by time
+func (p *Aggregator) closeBefore(t time.Time, withLate bool) (candles []Candle) {
+	for m, bucket := range p.open {
+		if !time.Unix(m, 0).Before(t) {
 			continue
 		}
-		minuteCandle.Update(entry)
-		deduplicate[key] = struct{}{}
+		candles = append(candles, bucket.candle)
+		p.closed[m] = bucket.seen
+		delete(p.open, m)
+	}
+	if withLate || len(candles) > 0 {
+		for m, c := range p.late {
+			candles = append(candles, *c)
+			delete(p.late, m)
+		}
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].StartMinute.Before(candles[j].StartMinute) })
+	return candles
+}
+
+// Pending returns copies of candles of open minutes, which are not emitted yet, ordered by time
+func (p *Aggregator) Pending() []Candle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candles := make([]Candle, 0, len(p.open))
+	for _, bucket := range p.open {
+		c := NewCandle()
+		c.Merge(bucket.candle)
+		c.StartMinute = bucket.candle.StartMinute
+		candles = append(candles, c)
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].StartMinute.Before(candles[j].StartMinute) })
+	return candles
+}
+
+// BufferSize returns number of open minutes and minutes with collected late records, and number of deduplication
+// keys kept for open and emitted minutes and for DedupWindow
+func (p *Aggregator) BufferSize() (minutes, keys int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, bucket := range p.open {
+		keys += len(bucket.seen)
+	}
+	for _, seen := range p.closed {
+		keys += len(seen)
+	}
+	return len(p.open) + len(p.late), keys + len(p.dedup.counted)
+}
+
+// update adds log record to the candle if it's not a duplicate within the minute, nor within DedupWindow
+// if set, in which case every record is counted as a raw request. File is counted in the record's node
+// if NodeFiles is set, client IP in listeners sketches if Listeners is set, and location and autonomous system
+// if the record has them.
+func (p *Aggregator) update(c *Candle, entry LogRecord, newInMinute bool) {
+	if p.DedupWindow > 0 {
+		c.UpdateRequests(entry)
+		newInMinute = newInMinute && p.dedup.add(dedupID{ip: entry.FromIP, file: entry.FileName}, entry.Date, p.DedupWindow)
 	}
-	p.entries = nil
-	return minuteCandle, true
+	if !newInMinute {
+		return
+	}
+	c.Update(entry)
+	if p.NodeFiles {
+		c.UpdateNodeFile(entry)
+	}
+	if p.Listeners {
+		c.UpdateListeners(entry)
+	}
+	c.UpdateLocation(entry)
+	c.UpdateASN(entry)
+}
+
+// horizon returns max age of accepted records, which can't be less than the window
+func (p *Aggregator) horizon() time.Duration {
+	return max(p.Window, p.Lateness)
 }
@@ -1,17 +1,19 @@
 package store
 
 import (
+	"fmt"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testsTable = []struct {
-	in     LogRecord
-	out    Candle
-	dumped bool
+	in  LogRecord
+	out []Candle
 }{
 	{ // 0
 		LogRecord{
@@ -20,8 +22,7 @@ var testsTable = []struct {
 			DestHost: "n6.radio-t.com",
 			Date:     time.Time{},
 		},
-		Candle{}, // empty, not yet dumped
-		false,
+		nil, // empty, not yet dumped
 	},
 
 	{ // 1
@@ -31,8 +32,7 @@ var testsTable = []struct {
 			DestHost: "n6.radio-t.com",
 			Date:     time.Time{},
 		},
-		Candle{}, // empty, not yet dumped
-		false,
+		nil, // empty, not yet dumped
 	},
 
 	{ // 2
@@ -42,8 +42,7 @@ var testsTable = []struct {
 			DestHost: "n7.radio-t.com",
 			Date:     time.Time{},
 		},
-		Candle{}, // empty, not yet dumped
-		false,
+		nil, // empty, not yet dumped
 	},
 
 	{ // 3
@@ -53,14 +52,13 @@ var testsTable = []struct {
 			DestHost: "n7.radio-t.com",
 			Date:     time.Time{}.Add(time.Minute),
 		},
-		Candle{ // from first 3 entries
+		[]Candle{{ // from first 3 entries
 			Nodes: map[string]Info{
 				"n6.radio-t.com": {Volume: 2, Files: map[string]int{}},
 				"all":            {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1, "/rtfiles/rt_podcast562.mp3": 1}},
 			},
 			StartMinute: time.Time{},
-		},
-		true,
+		}},
 	},
 
 	{ // 4
@@ -70,14 +68,13 @@ var testsTable = []struct {
 			DestHost: "n7.radio-t.com",
 			Date:     time.Time{}.Add(time.Minute * 2),
 		},
-		Candle{ // from 4th entry
+		[]Candle{{ // from 4th entry
 			Nodes: map[string]Info{
 				"n7.radio-t.com": {Volume: 1, Files: map[string]int{}},
 				"all":            {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
 			},
 			StartMinute: time.Time{}.Add(time.Minute),
-		},
-		true,
+		}},
 	},
 }
 
@@ -87,9 +84,9 @@ func TestParsing(t *testing.T) {
 	// test LogRecord conversion to Candle
 	for i, tt := range testsTable {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			resultCandle, ok := parser.Store(tt.in)
-			assert.EqualValues(t, tt.out, resultCandle, "candle match with expected output")
-			assert.EqualValues(t, tt.dumped, ok, "entry (not) dumped")
+			resultCandles, err := parser.Store(tt.in)
+			require.NoError(t, err)
+			assert.EqualValues(t, tt.out, resultCandles, "candles match with expected output")
 		})
 	}
 }
@@ -97,9 +94,7 @@ func TestParsing(t *testing.T) {
 func TestFlush(t *testing.T) {
 	t.Run("empty aggregator", func(t *testing.T) {
 		parser := &Aggregator{}
-		candle, ok := parser.Flush()
-		assert.False(t, ok)
-		assert.Equal(t, Candle{}, candle)
+		assert.Empty(t, parser.Flush())
 	})
 
 	t.Run("buffered entries without minute boundary", func(t *testing.T) {
@@ -107,21 +102,24 @@ func TestFlush(t *testing.T) {
 		baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
 
 		// store entries within the same minute — no candle emitted
-		_, ok := parser.Store(LogRecord{
+		candles, err := parser.Store(LogRecord{
 			FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3",
 			DestHost: "n6.radio-t.com", Date: baseTime,
 		})
-		assert.False(t, ok)
+		require.NoError(t, err)
+		assert.Empty(t, candles)
 
-		_, ok = parser.Store(LogRecord{
+		candles, err = parser.Store(LogRecord{
 			FromIP: "10.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3",
 			DestHost: "n7.radio-t.com", Date: baseTime.Add(30 * time.Second),
 		})
-		assert.False(t, ok)
+		require.NoError(t, err)
+		assert.Empty(t, candles)
 
 		// flush should emit a candle with the buffered entries
-		candle, ok := parser.Flush()
-		assert.True(t, ok)
+		candles = parser.Flush()
+		require.Len(t, candles, 1)
+		candle := candles[0]
 		assert.Equal(t, 3, len(candle.Nodes), "should have n6, n7, and all")
 		assert.Equal(t, 1, candle.Nodes["n6.radio-t.com"].Volume)
 		assert.Equal(t, 1, candle.Nodes["n7.radio-t.com"].Volume)
@@ -135,42 +133,420 @@ func TestFlush(t *testing.T) {
 		baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
 
 		// first minute entry
-		_, ok := parser.Store(LogRecord{
+		candles, err := parser.Store(LogRecord{
 			FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3",
 			DestHost: "n6.radio-t.com", Date: baseTime,
 		})
-		assert.False(t, ok)
+		require.NoError(t, err)
+		assert.Empty(t, candles)
 
 		// second minute entry triggers candle for first minute
-		_, ok = parser.Store(LogRecord{
+		candles, err = parser.Store(LogRecord{
 			FromIP: "10.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3",
 			DestHost: "n7.radio-t.com", Date: baseTime.Add(time.Minute),
 		})
-		assert.True(t, ok)
+		require.NoError(t, err)
+		assert.Len(t, candles, 1)
 
 		// flush should only emit the trailing entry from the second minute
-		candle, ok := parser.Flush()
-		assert.True(t, ok)
-		assert.Equal(t, 2, len(candle.Nodes), "should have n7 and all")
-		assert.Equal(t, 1, candle.Nodes["n7.radio-t.com"].Volume)
-		assert.Equal(t, 1, candle.Nodes["all"].Volume)
+		candles = parser.Flush()
+		require.Len(t, candles, 1)
+		assert.Equal(t, 2, len(candles[0].Nodes), "should have n7 and all")
+		assert.Equal(t, 1, candles[0].Nodes["n7.radio-t.com"].Volume)
+		assert.Equal(t, 1, candles[0].Nodes["all"].Volume)
 	})
 
-	t.Run("double flush returns false", func(t *testing.T) {
+	t.Run("double flush returns nothing", func(t *testing.T) {
 		parser := &Aggregator{}
 		baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
 
-		parser.Store(LogRecord{
+		_, err := parser.Store(LogRecord{
 			FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3",
 			DestHost: "n6.radio-t.com", Date: baseTime,
 		})
+		require.NoError(t, err)
 
-		_, ok := parser.Flush()
-		assert.True(t, ok)
+		assert.Len(t, parser.Flush(), 1)
 
 		// second flush on empty buffer
-		candle, ok := parser.Flush()
-		assert.False(t, ok)
-		assert.Equal(t, Candle{}, candle)
+		assert.Empty(t, parser.Flush())
+	})
+
+	t.Run("records for flushed minute emitted as late", func(t *testing.T) {
+		parser := &Aggregator{}
+		baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		rec := LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime}
+
+		_, err := parser.Store(rec)
+		require.NoError(t, err)
+		assert.Len(t, parser.Flush(), 1)
+
+		candles, err := parser.Store(rec)
+		require.NoError(t, err)
+		assert.Empty(t, candles, "duplicate of flushed record ignored")
+
+		rec.FromIP = "127.0.0.2"
+		candles, err = parser.Store(rec)
+		require.NoError(t, err)
+		assert.Empty(t, candles, "late record collected till the next flush")
+		rec.FromIP = "127.0.0.3"
+		_, err = parser.Store(rec)
+		require.NoError(t, err)
+
+		candles = parser.Flush()
+		require.Len(t, candles, 1, "late records of the minute emitted as a single candle")
+		assert.Equal(t, 2, candles[0].Nodes["all"].Volume)
+		assert.Equal(t, baseTime, candles[0].StartMinute)
+		assert.Empty(t, parser.Flush())
 	})
 }
+
+func TestFlushBefore(t *testing.T) {
+	parser := &Aggregator{Window: 5 * time.Minute, Lateness: 10 * time.Minute}
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		_, err := parser.Store(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3",
+			DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Duration(i) * time.Minute)})
+		require.NoError(t, err)
+	}
+
+	assert.Empty(t, parser.FlushBefore(baseTime), "nothing started before the first minute")
+	minutes, keys := parser.BufferSize()
+	assert.Equal(t, 3, minutes)
+	assert.Equal(t, 3, keys)
+
+	candles := parser.FlushBefore(baseTime.Add(2 * time.Minute))
+	require.Len(t, candles, 2)
+	assert.Equal(t, baseTime, candles[0].StartMinute)
+	assert.Equal(t, baseTime.Add(time.Minute), candles[1].StartMinute)
+	minutes, keys = parser.BufferSize()
+	assert.Equal(t, 1, minutes)
+	assert.Equal(t, 3, keys, "keys of flushed minutes kept for late records")
+
+	// records for flushed minute collected as late ones, for open minute buffered
+	candles, err := parser.Store(LogRecord{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3",
+		DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Minute)})
+	require.NoError(t, err)
+	assert.Empty(t, candles)
+	candles, err = parser.Store(LogRecord{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3",
+		DestHost: "n6.radio-t.com", Date: baseTime.Add(2 * time.Minute)})
+	require.NoError(t, err)
+	assert.Empty(t, candles)
+	minutes, _ = parser.BufferSize()
+	assert.Equal(t, 2, minutes, "open minute and minute with late record")
+
+	candles = parser.FlushBefore(baseTime.Add(2 * time.Minute))
+	require.Len(t, candles, 1, "late candle emitted by flush without open minutes to emit")
+	assert.Equal(t, baseTime.Add(time.Minute), candles[0].StartMinute)
+	assert.Equal(t, 1, candles[0].Nodes["all"].Volume)
+
+	candles = parser.Flush()
+	require.Len(t, candles, 1)
+	assert.Equal(t, 2, candles[0].Nodes["all"].Volume)
+}
+
+func TestAggregator_OutOfOrder(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rec := func(ip string, minute int) LogRecord {
+		return LogRecord{FromIP: ip, FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+			Date: baseTime.Add(time.Duration(minute)*time.Minute + 10*time.Second)}
+	}
+	volumes := func(candles []Candle) map[int]int {
+		res := map[int]int{}
+		for _, c := range candles {
+			res[int(c.StartMinute.Sub(baseTime)/time.Minute)] += c.Nodes["all"].Volume
+		}
+		return res
+	}
+
+	t.Run("records within window don't split minutes", func(t *testing.T) {
+		parser := &Aggregator{Window: 2 * time.Minute}
+		var emitted []Candle
+		for _, r := range []LogRecord{rec("1", 0), rec("2", 1), rec("3", 0), rec("4", 2), rec("5", 0), rec("6", 1), rec("7", 3)} {
+			candles, err := parser.Store(r)
+			require.NoError(t, err)
+			emitted = append(emitted, candles...)
+		}
+		require.Len(t, emitted, 1, "minute 0 closed by minute 3")
+		assert.Equal(t, map[int]int{0: 3}, volumes(emitted))
+
+		flushed := parser.Flush()
+		require.Len(t, flushed, 3)
+		assert.Equal(t, map[int]int{1: 2, 2: 1, 3: 1}, volumes(flushed))
+		assert.Equal(t, baseTime.Add(time.Minute), flushed[0].StartMinute, "ordered by time")
+	})
+
+	t.Run("late records emitted separately and deduplicated", func(t *testing.T) {
+		parser := &Aggregator{Lateness: 5 * time.Minute}
+		var emitted []Candle
+		for _, r := range []LogRecord{rec("1", 0), rec("2", 0), rec("3", 1), rec("1", 0), rec("4", 0), rec("5", 2), rec("6", 3)} {
+			candles, err := parser.Store(r)
+			require.NoError(t, err)
+			emitted = append(emitted, candles...)
+		}
+		assert.Equal(t, map[int]int{0: 3, 1: 1, 2: 1}, volumes(emitted), "duplicate of ip 1 ignored, ip 4 merged into minute 0")
+		assert.Len(t, emitted, 4, "late record emitted as separate candle with the next minute")
+
+		// records for the minute which never was open
+		for _, r := range []LogRecord{rec("7", -1), rec("8", -1)} {
+			candles, err := parser.Store(r)
+			require.NoError(t, err)
+			assert.Empty(t, candles)
+		}
+		candles := parser.Flush()
+		require.Len(t, candles, 2)
+		assert.Equal(t, map[int]int{-1: 2, 3: 1}, volumes(candles))
+		assert.Equal(t, baseTime.Add(-time.Minute), candles[0].StartMinute, "ordered by time")
+	})
+
+	t.Run("records older than lateness rejected", func(t *testing.T) {
+		parser := &Aggregator{Window: time.Minute, Lateness: 3 * time.Minute}
+		_, err := parser.Store(rec("1", 10))
+		require.NoError(t, err)
+		_, err = parser.Store(rec("2", 7))
+		assert.NoError(t, err)
+		_, err = parser.Store(rec("3", 6))
+		assert.ErrorIs(t, err, ErrTooLate)
+
+		parser = &Aggregator{}
+		_, err = parser.Store(rec("1", 1))
+		require.NoError(t, err)
+		_, err = parser.Store(rec("2", 0))
+		assert.ErrorIs(t, err, ErrTooLate, "no lateness allowed by default")
+	})
+
+	t.Run("records from the future rejected", func(t *testing.T) {
+		parser := &Aggregator{Window: 5 * time.Minute}
+		now := time.Now()
+		_, err := parser.Store(LogRecord{FromIP: "1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+			Date: now.Add(24 * time.Hour)})
+		assert.ErrorIs(t, err, ErrTooEarly)
+		_, err = parser.Store(LogRecord{FromIP: "2", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+			Date: now.Add(3 * time.Minute)})
+		require.NoError(t, err, "clock skew within the window allowed")
+		_, err = parser.Store(LogRecord{FromIP: "3", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+			Date: now.Add(-time.Minute)})
+		assert.NoError(t, err, "future record didn't move the window")
+
+		parser = &Aggregator{}
+		_, err = parser.Store(LogRecord{FromIP: "1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+			Date: now.Add(2 * time.Minute)})
+		assert.ErrorIs(t, err, ErrTooEarly, "a minute allowed without window")
+	})
+}
+
+func TestAggregator_Concurrent(t *testing.T) {
+	const workers, records = 20, 100
+	parser := &Aggregator{}
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range records {
+				// every record is stored twice and must be deduplicated
+				rec := LogRecord{FromIP: fmt.Sprintf("10.0.%d.%d", w, i), FileName: "/rtfiles/rt_podcast561.mp3",
+					DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Duration(i%60) * time.Second)}
+				candles, err := parser.Store(rec)
+				assert.NoError(t, err)
+				assert.Empty(t, candles, "no minute change")
+				candles, err = parser.Store(rec)
+				assert.NoError(t, err)
+				assert.Empty(t, candles, "no minute change")
+			}
+		}()
+	}
+	wg.Wait()
+
+	candles, err := parser.Store(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3",
+		DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, candles, 1)
+	assert.Equal(t, workers*records, candles[0].Nodes["n6.radio-t.com"].Volume)
+	assert.Equal(t, workers*records, candles[0].Nodes["all"].Volume)
+	assert.Equal(t, workers*records, candles[0].Nodes["all"].Files["/rtfiles/rt_podcast561.mp3"])
+
+	candles = parser.Flush()
+	require.Len(t, candles, 1)
+	assert.Equal(t, 1, candles[0].Nodes["all"].Volume)
+}
+
+func TestAggregator_NodeFiles(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	records := []LogRecord{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime}, // duplicate
+		{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n7.radio-t.com", Date: baseTime},
+	}
+	store := func(parser *Aggregator) Candle {
+		for _, rec := range records {
+			_, err := parser.Store(rec)
+			require.NoError(t, err)
+		}
+		candles := parser.Flush()
+		require.Len(t, candles, 1)
+		return candles[0]
+	}
+
+	candle := store(&Aggregator{})
+	assert.Empty(t, candle.Nodes["n6.radio-t.com"].Files, "files counted in all node only by default")
+	assert.Len(t, candle.Nodes["all"].Files, 2)
+
+	candle = store(&Aggregator{NodeFiles: true})
+	assert.Equal(t, Info{Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}}, candle.Nodes["n6.radio-t.com"])
+	assert.Equal(t, Info{Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast562.mp3": 1}}, candle.Nodes["n7.radio-t.com"])
+	assert.Len(t, candle.Nodes["all"].Files, 2)
+}
+
+func TestAggregator_Pending(t *testing.T) {
+	parser := &Aggregator{Window: 5 * time.Minute}
+	assert.Empty(t, parser.Pending())
+
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, r := range []LogRecord{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Minute)},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+		{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n7.radio-t.com", Date: baseTime},
+	} {
+		_, err := parser.Store(r)
+		require.NoError(t, err)
+	}
+
+	pending := parser.Pending()
+	require.Len(t, pending, 2)
+	assert.Equal(t, baseTime, pending[0].StartMinute)
+	assert.Equal(t, 2, pending[0].Nodes["all"].Volume)
+	assert.Equal(t, baseTime.Add(time.Minute), pending[1].StartMinute)
+	assert.Equal(t, 1, pending[1].Nodes["all"].Volume)
+
+	// returned candles are copies
+	pending[0].Nodes["all"].Files["/rtfiles/rt_podcast561.mp3"] = 100
+	candles := parser.Flush()
+	require.Len(t, candles, 2)
+	assert.Equal(t, 2, candles[0].Nodes["all"].Files["/rtfiles/rt_podcast561.mp3"])
+	assert.Empty(t, parser.Pending(), "flushed minutes are not pending")
+}
+
+func TestAggregator_Listeners(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	records := []LogRecord{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+		{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+	}
+
+	parser := &Aggregator{}
+	for _, r := range records {
+		_, err := parser.Store(r)
+		require.NoError(t, err)
+	}
+	candles := parser.Flush()
+	require.Len(t, candles, 1)
+	assert.Nil(t, candles[0].Listeners, "listeners not collected by default")
+
+	parser = &Aggregator{Listeners: true}
+	for _, r := range records {
+		_, err := parser.Store(r)
+		require.NoError(t, err)
+	}
+	candles = parser.Flush()
+	require.Len(t, candles, 1)
+	require.NotNil(t, candles[0].Listeners)
+	assert.Equal(t, 2, candles[0].Listeners.Nodes["n6.radio-t.com"].Count())
+	assert.Equal(t, 1, candles[0].Listeners.Files["/rtfiles/rt_podcast562.mp3"].Count())
+}
+
+func TestAggregator_DedupWindow(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	records := []LogRecord{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime}, // same minute
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n7.radio-t.com", Date: baseTime.Add(time.Minute)},
+		{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Minute)},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n6.radio-t.com", Date: baseTime.Add(2 * time.Minute)},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Hour)},
+	}
+	store := func(parser *Aggregator) (candles []Candle) {
+		for _, r := range records {
+			c, err := parser.Store(r)
+			require.NoError(t, err)
+			candles = append(candles, c...)
+		}
+		return append(candles, parser.Flush()...)
+	}
+
+	candles := store(&Aggregator{})
+	require.Len(t, candles, 4)
+	assert.Equal(t, 2, candles[1].Nodes["all"].Volume, "retry in the next minute counted by default")
+	assert.Nil(t, candles[1].Requests, "requests not counted by default")
+
+	parser := &Aggregator{DedupWindow: 30 * time.Minute}
+	candles = store(parser)
+	require.Len(t, candles, 4)
+	assert.Equal(t, 1, candles[0].Nodes["all"].Volume)
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 2, "all": 2}, candles[0].Requests)
+	assert.Equal(t, Info{Volume: 1, Files: map[string]int{}}, candles[1].Nodes["n6.radio-t.com"])
+	assert.NotContains(t, candles[1].Nodes, "n7.radio-t.com", "retry within window is not a download")
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 1, "n7.radio-t.com": 1, "all": 2}, candles[1].Requests)
+	assert.Equal(t, 1, candles[2].Nodes["all"].Volume, "other file is a separate download")
+	assert.Equal(t, 1, candles[3].Nodes["all"].Volume, "download counted again after window")
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 1, "all": 1}, candles[3].Requests)
+
+	keys := parser.NewDedupKeys()
+	assert.Equal(t, []DedupKey{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", Counted: baseTime.Add(time.Hour)},
+	}, keys, "keys out of window are forgotten")
+	_, n := parser.BufferSize()
+	assert.Equal(t, 2, n, "key of the latest flushed minute and key of the window")
+
+	// restored keys are not counted again
+	parser = &Aggregator{DedupWindow: 30 * time.Minute}
+	parser.RestoreDedup(keys)
+	assert.Empty(t, parser.NewDedupKeys(), "restored keys are saved already")
+	_, err := parser.Store(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+		Date: baseTime.Add(time.Hour + 10*time.Minute)})
+	require.NoError(t, err)
+	candles = parser.Flush()
+	require.Len(t, candles, 1)
+	assert.Empty(t, candles[0].Nodes)
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 1, "all": 1}, candles[0].Requests)
+}
+
+func TestAggregator_DedupLate(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	parser := &Aggregator{Lateness: 15 * time.Minute, DedupWindow: time.Hour}
+	for _, r := range []LogRecord{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime},
+		{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: baseTime.Add(5 * time.Minute)},
+	} {
+		_, err := parser.Store(r)
+		require.NoError(t, err)
+	}
+
+	// late duplicate of emitted minute is counted as a request only
+	candles, err := parser.Store(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+		Date: baseTime})
+	require.NoError(t, err)
+	assert.Empty(t, candles)
+	candles = parser.FlushBefore(baseTime)
+	require.Len(t, candles, 1)
+	assert.Equal(t, baseTime, candles[0].StartMinute)
+	assert.Empty(t, candles[0].Nodes)
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 1, "all": 1}, candles[0].Requests)
+}
+
+func TestAggregator_DedupLimit(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	parser := &Aggregator{DedupWindow: time.Hour, DedupLimit: 2}
+	for i := range 3 {
+		_, err := parser.Store(LogRecord{FromIP: fmt.Sprintf("127.0.0.%d", i), FileName: "/rtfiles/rt_podcast561.mp3",
+			DestHost: "n6.radio-t.com", Date: baseTime.Add(time.Duration(i) * time.Minute)})
+		require.NoError(t, err)
+	}
+	keys := parser.NewDedupKeys()
+	require.Len(t, keys, 2)
+	assert.Equal(t, "127.0.0.1", keys[0].FromIP, "the oldest key is forgotten")
+	assert.Equal(t, "127.0.0.2", keys[1].FromIP)
+}
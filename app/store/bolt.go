@@ -5,17 +5,30 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
 	bolt "go.etcd.io/bbolt"
 )
 
-var bucket = []byte("stats")
+var (
+	bucket       = []byte("stats")        // minute candles
+	hourlyBucket = []byte("stats_hourly") // hourly rollups of minute candles
+	dailyBucket  = []byte("stats_daily")  // daily rollups of minute candles
+	metaBucket   = []byte("meta")         // storage metadata
+)
 
 // Bolt implements store.Engine with boltdb
 type Bolt struct {
+	NodeFiles int // max files kept per node in every stored candle, "all" node is not limited; zero means no limit
+	ASNs      int // max autonomous systems kept in every stored candle, zero means no limit
+
 	db *bolt.DB
+
+	statusLock sync.Mutex
+	status     CompactionStatus
 }
 
 // NewBolt makes persistent boltdb based store
@@ -26,15 +39,41 @@ func NewBolt(dbFile string) (*Bolt, error) {
 		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, e := tx.CreateBucketIfNotExists(bucket)
-		return e
+		for _, b := range [][]byte{bucket, hourlyBucket, dailyBucket, metaBucket, dedupBucket} {
+			if _, e := tx.CreateBucketIfNotExists(b); e != nil {
+				return e
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	if err = db.Update(buildRollups); err != nil {
+		return nil, fmt.Errorf("can't build rollups: %w", err)
+	}
 	return &Bolt{db: db}, nil
 }
 
+// StorageStats reports size of the storage
+type StorageStats struct {
+	Size    int64          `json:"size"`    // size of the database file in bytes
+	Candles map[string]int `json:"candles"` // number of stored candles by resolution: minute, hour and day
+}
+
+// StorageStats returns size of boltdb file and number of stored candles
+func (s *Bolt) StorageStats() (stats StorageStats, err error) {
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return stats, err
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		stats = StorageStats{Size: info.Size(), Candles: countCandles(tx)}
+		return nil
+	})
+	return stats, err
+}
+
 // Close closes the underlying boltdb
 func (s *Bolt) Close() error {
 	return s.db.Close()
@@ -43,15 +82,20 @@ func (s *Bolt) Close() error {
 // Save Candles with starting minute time.Unix() as a key for bolt range query.
 // keys are decimal Unix timestamps; lexicographic ordering matches numeric ordering
 // because all timestamps since 1973 are 10 digits (remains true until 2286).
+// Save is additive: if a candle for the same minute is already stored, both are merged
+// in the same transaction, so candles for the same minute from restarts, flushes followed by
+// resumed traffic or from multiple instances are summed up instead of replacing each other.
+// Hourly and daily rollups are updated with the candle in the same transaction.
 func (s *Bolt) Save(candle Candle) (err error) {
-	key := fmt.Sprintf("%d", candle.StartMinute.Unix())
 	err = s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		jdata, jerr := json.Marshal(candle)
-		if jerr != nil {
-			return jerr
+		for _, r := range resolutions {
+			rollup := candle
+			rollup.StartMinute = candle.StartMinute.Truncate(r.span)
+			if err := mergeCandle(tx.Bucket(r.bucket), rollup, s.NodeFiles, s.ASNs); err != nil {
+				return err
+			}
 		}
-		return b.Put([]byte(key), jdata)
+		return nil
 	})
 	if err != nil {
 		return err
@@ -60,30 +104,82 @@ func (s *Bolt) Save(candle Candle) (err error) {
 	return nil
 }
 
-// Load Candles by period
+// mergeCandle puts candle to the bucket, merging it with the one already stored for the same time.
+// Files of every node except "all" are limited to top nodeFiles ones after the merge, and autonomous systems
+// to top asns ones.
+func mergeCandle(b *bolt.Bucket, candle Candle, nodeFiles, asns int) error {
+	key := fmt.Appendf(nil, "%d", candle.StartMinute.Unix())
+	merged := NewCandle()
+	if v := b.Get(key); v != nil {
+		if err := json.Unmarshal(v, &merged); err != nil {
+			return fmt.Errorf("can't decode stored candle %s: %w", key, err)
+		}
+	}
+	// merged into a new candle, as limiting files modifies it
+	merged.Merge(candle)
+	merged.StartMinute = candle.StartMinute
+	merged.LimitNodeFiles(nodeFiles)
+	merged.LimitASNs(asns)
+	jdata, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, jdata)
+}
+
+// Load minute Candles by period. Periods for which minute candles expired are returned as hourly or daily candles.
 func (s *Bolt) Load(ctx context.Context, periodStart, periodEnd time.Time) (result []Candle, err error) {
 	result = []Candle{}
-	err = s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		c := b.Cursor()
+	err = s.Iterate(ctx, periodStart, periodEnd, time.Minute, func(c Candle) error {
+		result = append(result, c)
+		return nil
+	})
+	return result, err
+}
 
-		minimum := fmt.Appendf(nil, "%d", periodStart.Unix())
-		maximum := fmt.Appendf(nil, "%d", periodEnd.Unix())
+// Iterate calls fn for Candles covering the period, ordered by time, reading them from the bolt cursor one by one.
+// Resolution is one of time.Minute, time.Hour or 24*time.Hour, finer resolution is rounded up to the coarser one.
+// Whole intervals of given resolution within the period are covered by candles of that resolution, and partial
+// intervals at the edges of the period by finer candles, so counts match the period. Periods for which candles
+// of the needed resolution expired are covered by coarser candles, which can reach beyond the period.
+// Iteration stops on the first error returned by fn. fn is called within read transaction,
+// so it must not call storage methods modifying data.
+func (s *Bolt) Iterate(ctx context.Context, periodStart, periodEnd time.Time, resolution time.Duration, fn func(Candle) error) error {
+	first := len(resolutions) - 1
+	for i, r := range resolutions {
+		if r.span >= resolution {
+			first = i
+			break
+		}
+	}
 
-		for k, v := c.Seek(minimum); k != nil && bytes.Compare(k, maximum) <= 0; k, v = c.Next() {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-			}
-			newCandle := Candle{}
-			err = json.Unmarshal(v, &newCandle)
-			if err != nil {
-				return err
+	return s.db.View(func(tx *bolt.Tx) error {
+		p := coverage{covered: make([]int64, len(resolutions))}
+		for i := range resolutions {
+			p.covered[i] = coveredSince(tx, i)
+		}
+		// candles started within the period, so the partial first minute is skipped
+		p.exact(ceilTo(periodStart.Unix(), 60), periodEnd.Unix(), first)
+
+		for _, seg := range p.segments {
+			c := tx.Bucket(resolutions[seg.res].bucket).Cursor()
+			minimum := fmt.Appendf(nil, "%d", seg.from)
+			maximum := fmt.Appendf(nil, "%d", seg.to)
+			for k, v := c.Seek(minimum); k != nil && bytes.Compare(k, maximum) <= 0; k, v = c.Next() {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				default:
+				}
+				newCandle := Candle{}
+				if err := json.Unmarshal(v, &newCandle); err != nil {
+					return err
+				}
+				if err := fn(newCandle); err != nil {
+					return err
+				}
 			}
-			result = append(result, newCandle)
 		}
 		return nil
 	})
-	return result, err
 }
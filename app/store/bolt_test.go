@@ -2,12 +2,14 @@ package store
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestSaveAndLoadLogEntryBolt(t *testing.T) {
@@ -45,3 +47,242 @@ func TestBolt_Close(t *testing.T) {
 	assert.NoError(t, s.Close())
 }
 
+func TestBolt_SaveMerge(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	minute := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rec := func(ip, node string, sec int) LogRecord {
+		return LogRecord{FromIP: ip, FileName: "/rtfiles/rt_podcast561.mp3", DestHost: node,
+			Date: minute.Add(time.Duration(sec) * time.Second)}
+	}
+	load := func() Candle {
+		candles, lerr := s.Load(context.Background(), minute, minute)
+		require.NoError(t, lerr)
+		require.Len(t, candles, 1)
+		return candles[0]
+	}
+
+	t.Run("flush then resume", func(t *testing.T) {
+		parser := &Aggregator{}
+		_, err = parser.Store(rec("127.0.0.1", "n6.radio-t.com", 5))
+		require.NoError(t, err)
+		for _, c := range parser.Flush() {
+			require.NoError(t, s.Save(c))
+		}
+
+		// aggregator restarted in the middle of the same minute
+		parser = &Aggregator{}
+		_, err = parser.Store(rec("127.0.0.2", "n7.radio-t.com", 30))
+		require.NoError(t, err)
+		_, err = parser.Store(rec("127.0.0.3", "n6.radio-t.com", 40))
+		require.NoError(t, err)
+		for _, c := range parser.Flush() {
+			require.NoError(t, s.Save(c))
+		}
+
+		candle := load()
+		assert.Equal(t, minute, candle.StartMinute.UTC())
+		assert.Equal(t, 2, candle.Nodes["n6.radio-t.com"].Volume)
+		assert.Equal(t, 1, candle.Nodes["n7.radio-t.com"].Volume)
+		assert.Equal(t, 3, candle.Nodes["all"].Volume)
+		assert.Equal(t, map[string]int{"/rtfiles/rt_podcast561.mp3": 3}, candle.Nodes["all"].Files)
+	})
+
+	t.Run("duplicate minute from another instance", func(t *testing.T) {
+		other := NewCandle()
+		other.Update(rec("10.0.0.1", "n8.radio-t.com", 0))
+		other.StartMinute = minute
+		require.NoError(t, s.Save(other))
+		require.NoError(t, s.Save(other))
+
+		candle := load()
+		assert.Equal(t, 2, candle.Nodes["n8.radio-t.com"].Volume)
+		assert.Equal(t, 2, candle.Nodes["n6.radio-t.com"].Volume, "untouched")
+		assert.Equal(t, 5, candle.Nodes["all"].Volume)
+		assert.Equal(t, map[string]int{"/rtfiles/rt_podcast561.mp3": 5}, candle.Nodes["all"].Files)
+	})
+
+	t.Run("broken stored candle", func(t *testing.T) {
+		broken := minute.Add(time.Minute)
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucket).Put(fmt.Appendf(nil, "%d", broken.Unix()), []byte("bad json"))
+		})
+		require.NoError(t, err)
+		c := NewCandle()
+		c.StartMinute = broken
+		assert.ErrorContains(t, s.Save(c), "can't decode stored candle")
+	})
+}
+
+func TestBolt_SaveNodeFiles(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+	s.NodeFiles = 2
+
+	// every minute n6 serves two new files and one file seen in every minute
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		c := NewCandle()
+		for name, count := range map[string]int{"common": 3, fmt.Sprintf("a%d", i): 2, fmt.Sprintf("b%d", i): 2} {
+			for range count {
+				rec := LogRecord{FileName: name, DestHost: "n6.radio-t.com", Date: start.Add(time.Duration(i) * time.Minute)}
+				c.Update(rec)
+				c.UpdateNodeFile(rec)
+			}
+		}
+		require.NoError(t, s.Save(c))
+		assert.Len(t, c.Nodes["n6.radio-t.com"].Files, 3, "saved candle not modified")
+	}
+
+	minutes, err := s.Load(context.Background(), start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, minutes, 3)
+	assert.Equal(t, Info{Volume: 7, Files: map[string]int{"common": 3, "a0": 2}}, minutes[0].Nodes["n6.radio-t.com"])
+	assert.Len(t, minutes[0].Nodes["all"].Files, 3, "all node not limited")
+
+	hours, err := loadResolution(context.Background(), s, start, start.Add(time.Hour), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, hours, 1)
+	assert.Equal(t, Info{Volume: 21, Files: map[string]int{"common": 9, "a0": 2}}, hours[0].Nodes["n6.radio-t.com"])
+	assert.Len(t, hours[0].Nodes["all"].Files, 7)
+}
+
+func TestBolt_Iterate(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		c := NewCandle()
+		c.Update(LogRecord{FileName: "rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: start.Add(time.Duration(i) * time.Minute)})
+		require.NoError(t, s.Save(c))
+	}
+
+	ctx := context.Background()
+	loaded, err := s.Load(ctx, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	var iterated []Candle
+	err = s.Iterate(ctx, start, start.Add(time.Hour), time.Minute, func(c Candle) error {
+		iterated = append(iterated, c)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, loaded, iterated)
+
+	// iteration stops on the first error
+	calls := 0
+	err = s.Iterate(ctx, start, start.Add(time.Hour), time.Minute, func(c Candle) error {
+		calls++
+		if calls == 2 {
+			return fmt.Errorf("stop")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "stop")
+	assert.Equal(t, 2, calls)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = s.Iterate(cancelled, start, start.Add(time.Hour), time.Minute, func(c Candle) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBolt_StorageStats(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		c := NewCandle()
+		c.Update(LogRecord{FileName: "rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: start.Add(time.Duration(i) * time.Minute)})
+		require.NoError(t, s.Save(c))
+	}
+
+	stats, err := s.StorageStats()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"minute": 3, "hour": 1, "day": 1}, stats.Candles)
+	info, err := os.Stat(file.Name())
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), stats.Size)
+}
+
+func TestBolt_SaveListeners(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// the same two listeners every minute, and a new one each minute
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		c := NewCandle()
+		for _, ip := range []string{"127.0.0.1", "127.0.0.2", fmt.Sprintf("10.0.0.%d", i)} {
+			l := LogRecord{FromIP: ip, FileName: "rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: start.Add(time.Duration(i) * time.Minute)}
+			c.Update(l)
+			c.UpdateListeners(l)
+		}
+		require.NoError(t, s.Save(c))
+	}
+
+	minutes, err := s.Load(context.Background(), start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, minutes, 5)
+	assert.Equal(t, 3, minutes[0].Listeners.Nodes["all"].Count())
+
+	for _, resolution := range []time.Duration{time.Hour, 24 * time.Hour} {
+		rollups, err := loadResolution(context.Background(), s, start.Truncate(resolution), start.Add(time.Hour), resolution)
+		require.NoError(t, err)
+		require.Len(t, rollups, 1)
+		assert.Equal(t, 15, rollups[0].Nodes["all"].Volume)
+		assert.Equal(t, 7, rollups[0].Listeners.Nodes["all"].Count(), "unique listeners of rollup")
+		assert.Equal(t, 7, rollups[0].Listeners.Files["rt_podcast561.mp3"].Count())
+	}
+}
+
+func TestBolt_SaveASNs(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+	s.ASNs = 2
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, asns := range []map[string]int{{"AS1": 3, "AS2": 2, "AS3": 1}, {"AS3": 5, "AS4": 1}} {
+		c := NewCandle()
+		c.Update(LogRecord{FileName: "rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: start.Add(time.Duration(i) * time.Minute)})
+		c.ASNs = asns
+		require.NoError(t, s.Save(c))
+	}
+
+	minutes, err := s.Load(context.Background(), start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, minutes, 2)
+	assert.Equal(t, map[string]int{"AS1": 3, "AS2": 2}, minutes[0].ASNs)
+	assert.Equal(t, map[string]int{"AS3": 5, "AS4": 1}, minutes[1].ASNs)
+
+	hours, err := loadResolution(context.Background(), s, start, start.Add(time.Hour), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, hours, 1)
+	assert.Equal(t, map[string]int{"AS3": 5, "AS1": 3}, hours[0].ASNs, "rollup is limited after every merge")
+}
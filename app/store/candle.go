@@ -1,6 +1,7 @@
 package store
 
 import (
+	"sort"
 	"time"
 )
 
@@ -8,6 +9,22 @@ import (
 type Candle struct {
 	Nodes       map[string]Info
 	StartMinute time.Time
+	Listeners   *Listeners     `json:",omitempty"` // set only if unique listeners are counted, see Aggregator.Listeners
+	Requests    map[string]int `json:",omitempty"` // raw requests including duplicates by node, including "all", see Aggregator.DedupWindow
+	Countries   map[string]int `json:",omitempty"` // downloads by ISO 3166-1 country code, from all nodes
+	Regions     map[string]int `json:",omitempty"` // downloads by ISO 3166-2 region code like US-CA, from all nodes
+	ASNs        map[string]int `json:",omitempty"` // downloads by autonomous system like "AS64512 Example", from all nodes
+}
+
+// Listeners contains sketches of client IPs for estimation of unique listeners
+type Listeners struct {
+	Nodes map[string]*HLL `json:"nodes"` // by node, including "all"
+	Files map[string]*HLL `json:"files"` // by file, from all nodes
+}
+
+// NewListeners makes empty listeners sketches
+func NewListeners() *Listeners {
+	return &Listeners{Nodes: map[string]*HLL{}, Files: map[string]*HLL{}}
 }
 
 // Info contain single node download statistics
@@ -30,6 +47,9 @@ type LogRecord struct {
 	FileName string    `json:"file_name"`
 	DestHost string    `json:"dest"`
 	Date     time.Time `json:"ts"`
+	Country  string    `json:"-"` // country code of FromIP, set by enrichment on ingestion
+	Region   string    `json:"-"` // region code of FromIP, set by enrichment on ingestion
+	ASN      string    `json:"-"` // autonomous system of FromIP, set by enrichment on ingestion
 }
 
 // NewCandle create empty candle
@@ -54,3 +74,172 @@ func (c *Candle) Update(l LogRecord) {
 	}
 	c.StartMinute = l.Date
 }
+
+// Merge adds node volumes, file counts, requests, locations and autonomous systems of other candle to the candle, StartMinute is kept intact
+func (c *Candle) Merge(other Candle) {
+	if c.Nodes == nil {
+		c.Nodes = map[string]Info{}
+	}
+	for nodeName, otherNode := range other.Nodes {
+		node, ok := c.Nodes[nodeName]
+		if !ok || node.Files == nil {
+			node.Files = map[string]int{}
+		}
+		for file, count := range otherNode.Files {
+			node.Files[file] += count
+		}
+		node.Volume += otherNode.Volume
+		c.Nodes[nodeName] = node
+	}
+	c.Requests = mergeCounts(c.Requests, other.Requests)
+	c.Countries = mergeCounts(c.Countries, other.Countries)
+	c.Regions = mergeCounts(c.Regions, other.Regions)
+	c.ASNs = mergeCounts(c.ASNs, other.ASNs)
+	if other.Listeners != nil {
+		if c.Listeners == nil {
+			c.Listeners = NewListeners()
+		}
+		c.Listeners.merge(other.Listeners)
+	}
+}
+
+// UpdateRequests counts raw request of the log record in its destination node and "all" node
+func (c *Candle) UpdateRequests(l LogRecord) {
+	if c.Requests == nil {
+		c.Requests = map[string]int{}
+	}
+	c.Requests[l.DestHost]++
+	c.Requests["all"]++
+	c.StartMinute = l.Date
+}
+
+// UpdateLocation counts download of the log record in its country and region, if they are known
+func (c *Candle) UpdateLocation(l LogRecord) {
+	if l.Country != "" {
+		c.Countries = mergeCounts(c.Countries, map[string]int{l.Country: 1})
+	}
+	if l.Region != "" {
+		c.Regions = mergeCounts(c.Regions, map[string]int{l.Region: 1})
+	}
+}
+
+// UpdateASN counts download of the log record in its autonomous system, if it's known
+func (c *Candle) UpdateASN(l LogRecord) {
+	if l.ASN != "" {
+		c.ASNs = mergeCounts(c.ASNs, map[string]int{l.ASN: 1})
+	}
+}
+
+// mergeCounts adds src counts to dst, making dst if it's nil and there is something to add
+func mergeCounts(dst, src map[string]int) map[string]int {
+	for k, v := range src {
+		if dst == nil {
+			dst = map[string]int{}
+		}
+		dst[k] += v
+	}
+	return dst
+}
+
+// UpdateListeners adds client IP of the log record to sketches of its destination node, "all" node and the file
+func (c *Candle) UpdateListeners(l LogRecord) {
+	if c.Listeners == nil {
+		c.Listeners = NewListeners()
+	}
+	for _, nodeName := range []string{l.DestHost, "all"} {
+		addToSketch(c.Listeners.Nodes, nodeName, l.FromIP)
+	}
+	addToSketch(c.Listeners.Files, l.FileName, l.FromIP)
+}
+
+// merge adds sketches of other listeners, sketches are copied so other can be modified later
+func (l *Listeners) merge(other *Listeners) {
+	for _, m := range []struct{ dst, src map[string]*HLL }{{l.Nodes, other.Nodes}, {l.Files, other.Files}} {
+		for name, sketch := range m.src {
+			if existing, ok := m.dst[name]; ok {
+				existing.Merge(sketch)
+				continue
+			}
+			m.dst[name] = sketch.Clone()
+		}
+	}
+}
+
+// addToSketch adds value to the named sketch, creating the sketch if needed
+func addToSketch(sketches map[string]*HLL, name, value string) {
+	sketch, ok := sketches[name]
+	if !ok {
+		sketch = &HLL{}
+		sketches[name] = sketch
+	}
+	sketch.Add(value)
+}
+
+// UpdateNodeFile counts file of the log record in its destination node, as Update counts files in "all" node only
+func (c *Candle) UpdateNodeFile(l LogRecord) {
+	node, ok := c.Nodes[l.DestHost]
+	if !ok {
+		node = NewInfo()
+	}
+	if node.Files == nil {
+		node.Files = map[string]int{}
+	}
+	node.Files[l.FileName]++
+	c.Nodes[l.DestHost] = node
+}
+
+// LimitNodeFiles keeps only top n files by count in every node except "all", zero n means no limit.
+// Volume of the nodes stays intact, so sum of the kept file counts can be less than node volume.
+func (c *Candle) LimitNodeFiles(n int) {
+	if n <= 0 {
+		return
+	}
+	for name, node := range c.Nodes {
+		if name == "all" || len(node.Files) <= n {
+			continue
+		}
+		c.Nodes[name] = Info{Volume: node.Volume, Files: topCounts(node.Files, n)}
+	}
+}
+
+// LimitASNs keeps only top n autonomous systems by count, zero n means no limit.
+// Volume of the nodes stays intact, so sum of the kept counts can be less than volume of "all" node.
+func (c *Candle) LimitASNs(n int) {
+	if n > 0 && len(c.ASNs) > n {
+		c.ASNs = topCounts(c.ASNs, n)
+	}
+}
+
+// KeyCount is a key, like file name, country or autonomous system, with its count
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+// TopCounts returns up to n keys with the biggest counts, ordered by count and then by key, none if n is not positive
+func TopCounts(counts map[string]int, n int) []KeyCount {
+	if n <= 0 {
+		return []KeyCount{}
+	}
+	res := make([]KeyCount, 0, len(counts))
+	for k, v := range counts {
+		res = append(res, KeyCount{Key: k, Count: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	return res[:min(n, len(res))]
+}
+
+// topCounts returns map of up to n keys with the biggest counts, ties are resolved by key
+func topCounts(counts map[string]int, n int) map[string]int {
+	top := TopCounts(counts, n)
+	res := make(map[string]int, len(top))
+	for _, kc := range top {
+		res[kc.Key] = kc.Count
+	}
+	return res
+}
@@ -67,3 +67,163 @@ func TestNewAndUpdateCandle(t *testing.T) {
 		assert.EqualValues(t, testPair.out, candle, "candle match with expected output")
 	}
 }
+
+func TestCandleMerge(t *testing.T) {
+	candle := Candle{
+		Nodes: map[string]Info{
+			"n6.radio-t.com": {1, map[string]int{}},
+			"all":            {1, map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+		},
+		StartMinute: time.Unix(60, 0),
+	}
+	candle.Merge(Candle{
+		Nodes: map[string]Info{
+			"n7.radio-t.com": {2, nil},
+			"all":            {2, map[string]int{"/rtfiles/rt_podcast561.mp3": 1, "/rtfiles/rt_podcast562.mp3": 1}},
+		},
+		StartMinute: time.Unix(120, 0),
+	})
+	assert.Equal(t, Candle{
+		Nodes: map[string]Info{
+			"n6.radio-t.com": {1, map[string]int{}},
+			"n7.radio-t.com": {2, map[string]int{}},
+			"all":            {3, map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast562.mp3": 1}},
+		},
+		StartMinute: time.Unix(60, 0),
+	}, candle)
+
+	empty := Candle{}
+	empty.Merge(candle)
+	assert.Equal(t, candle.Nodes, empty.Nodes)
+}
+
+func TestCandleNodeFiles(t *testing.T) {
+	candle := NewCandle()
+	for _, rec := range []LogRecord{
+		{FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com"},
+		{FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n6.radio-t.com"},
+		{FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n6.radio-t.com"},
+		{FileName: "/rtfiles/rt_podcast563.mp3", DestHost: "n6.radio-t.com"},
+		{FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n7.radio-t.com"},
+	} {
+		candle.Update(rec)
+		candle.UpdateNodeFile(rec)
+	}
+	assert.Equal(t, map[string]Info{
+		"n6.radio-t.com": {4, map[string]int{"/rtfiles/rt_podcast561.mp3": 1, "/rtfiles/rt_podcast562.mp3": 2, "/rtfiles/rt_podcast563.mp3": 1}},
+		"n7.radio-t.com": {1, map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+		"all": {5, map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast562.mp3": 2,
+			"/rtfiles/rt_podcast563.mp3": 1}},
+	}, candle.Nodes)
+
+	candle.LimitNodeFiles(0)
+	assert.Len(t, candle.Nodes["n6.radio-t.com"].Files, 3, "no limit")
+
+	// ties resolved by file name, "all" node not limited
+	candle.LimitNodeFiles(2)
+	assert.Equal(t, map[string]Info{
+		"n6.radio-t.com": {4, map[string]int{"/rtfiles/rt_podcast561.mp3": 1, "/rtfiles/rt_podcast562.mp3": 2}},
+		"n7.radio-t.com": {1, map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+		"all": {5, map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast562.mp3": 2,
+			"/rtfiles/rt_podcast563.mp3": 1}},
+	}, candle.Nodes)
+
+	// node without files map
+	candle = Candle{Nodes: map[string]Info{"n6.radio-t.com": {Volume: 1}}}
+	candle.UpdateNodeFile(LogRecord{FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com"})
+	assert.Equal(t, Info{Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}}, candle.Nodes["n6.radio-t.com"])
+}
+
+func TestCandleListeners(t *testing.T) {
+	c := NewCandle()
+	for _, l := range []LogRecord{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com"},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n6.radio-t.com"},
+		{FromIP: "127.0.0.2", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n7.radio-t.com"},
+	} {
+		c.Update(l)
+		c.UpdateListeners(l)
+	}
+	assert.Equal(t, 1, c.Listeners.Nodes["n6.radio-t.com"].Count())
+	assert.Equal(t, 1, c.Listeners.Nodes["n7.radio-t.com"].Count())
+	assert.Equal(t, 2, c.Listeners.Nodes["all"].Count())
+	assert.Equal(t, 2, c.Listeners.Files["/rtfiles/rt_podcast561.mp3"].Count())
+	assert.Equal(t, 1, c.Listeners.Files["/rtfiles/rt_podcast562.mp3"].Count())
+
+	other := NewCandle()
+	l := LogRecord{FromIP: "127.0.0.3", FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n6.radio-t.com"}
+	other.Update(l)
+	other.UpdateListeners(l)
+
+	merged := NewCandle()
+	merged.Merge(c)
+	merged.Merge(other)
+	merged.Merge(NewCandle()) // candle without listeners
+	assert.Equal(t, 2, merged.Listeners.Nodes["n6.radio-t.com"].Count())
+	assert.Equal(t, 3, merged.Listeners.Nodes["all"].Count())
+	assert.Equal(t, 2, merged.Listeners.Files["/rtfiles/rt_podcast562.mp3"].Count())
+	assert.Equal(t, 2, c.Listeners.Nodes["all"].Count(), "merged candle not changed")
+
+	noListeners := NewCandle()
+	noListeners.Merge(NewCandle())
+	assert.Nil(t, noListeners.Listeners)
+}
+
+func TestCandleRequests(t *testing.T) {
+	start := time.Unix(60, 0)
+	candle := NewCandle()
+	candle.UpdateRequests(LogRecord{FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: start})
+	candle.UpdateRequests(LogRecord{FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n7.radio-t.com", Date: start})
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 1, "n7.radio-t.com": 1, "all": 2}, candle.Requests)
+	assert.Equal(t, start, candle.StartMinute)
+	assert.Empty(t, candle.Nodes, "requests don't count downloads")
+
+	merged := NewCandle()
+	merged.Merge(candle)
+	merged.Merge(candle)
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 2, "n7.radio-t.com": 2, "all": 4}, merged.Requests)
+	merged.Merge(NewCandle())
+	assert.Equal(t, 4, merged.Requests["all"])
+}
+
+func TestCandleLocation(t *testing.T) {
+	candle := NewCandle()
+	candle.UpdateLocation(LogRecord{Country: "US", Region: "US-CA"})
+	candle.UpdateLocation(LogRecord{Country: "US"})
+	candle.UpdateLocation(LogRecord{})
+	assert.Equal(t, map[string]int{"US": 2}, candle.Countries)
+	assert.Equal(t, map[string]int{"US-CA": 1}, candle.Regions)
+
+	merged := NewCandle()
+	merged.Merge(candle)
+	merged.Merge(Candle{Countries: map[string]int{"GB": 1}})
+	assert.Equal(t, map[string]int{"US": 2, "GB": 1}, merged.Countries)
+	assert.Equal(t, map[string]int{"US-CA": 1}, merged.Regions)
+	assert.Nil(t, NewCandle().Countries, "no locations by default")
+}
+
+func TestCandleASNs(t *testing.T) {
+	candle := NewCandle()
+	for _, asn := range []string{"AS1 One", "AS2 Two", "AS2 Two", "AS3 Three", "AS3 Three", ""} {
+		candle.UpdateASN(LogRecord{ASN: asn})
+	}
+	assert.Equal(t, map[string]int{"AS1 One": 1, "AS2 Two": 2, "AS3 Three": 2}, candle.ASNs)
+
+	candle.LimitASNs(0)
+	assert.Len(t, candle.ASNs, 3, "no limit")
+	candle.LimitASNs(2)
+	assert.Equal(t, map[string]int{"AS2 Two": 2, "AS3 Three": 2}, candle.ASNs)
+
+	candle.Merge(Candle{ASNs: map[string]int{"AS1 One": 3}})
+	assert.Equal(t, map[string]int{"AS1 One": 3, "AS2 Two": 2, "AS3 Three": 2}, candle.ASNs)
+}
+
+func TestTopCounts(t *testing.T) {
+	counts := map[string]int{"US": 2, "GB": 1, "DE": 2, "FR": 3}
+	assert.Equal(t, []KeyCount{{Key: "FR", Count: 3}, {Key: "DE", Count: 2}, {Key: "US", Count: 2}}, TopCounts(counts, 3),
+		"ordered by count and then by key")
+	assert.Len(t, TopCounts(counts, 10), 4, "limit above number of keys")
+	assert.Empty(t, TopCounts(counts, 0))
+	assert.Empty(t, TopCounts(counts, -1))
+	assert.Empty(t, TopCounts(nil, 10))
+}
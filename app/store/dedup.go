@@ -0,0 +1,150 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var dedupBucket = []byte("dedup") // downloads counted within deduplication window, by time, client IP and file
+
+// DedupKey is a client IP and file with time of the last download counted for them
+type DedupKey struct {
+	FromIP   string
+	FileName string
+	Counted  time.Time
+}
+
+// dedupID identifies downloads of the same file by the same client IP
+type dedupID struct {
+	ip, file string
+}
+
+// dedupEntry is a counted download in order of counting
+type dedupEntry struct {
+	id      dedupID
+	counted time.Time
+}
+
+// dedupSet remembers downloads counted for client IP and file pairs. Pairs are forgotten once they expire,
+// or, oldest first, once there are too many of them. Zero value is ready to use.
+type dedupSet struct {
+	counted map[dedupID]time.Time // time of the last counted download by pair
+	queue   []dedupEntry          // counted downloads in order of counting, entries of recounted pairs are stale
+	unsaved int                   // number of entries at the end of queue not returned by added yet
+}
+
+// add returns true and remembers the download if no download of the same pair was counted within window from t
+func (d *dedupSet) add(id dedupID, t time.Time, window time.Duration) bool {
+	if d.counted == nil {
+		d.counted = map[dedupID]time.Time{}
+	}
+	last, ok := d.counted[id]
+	if ok && t.Sub(last) < window && last.Sub(t) < window {
+		return false
+	}
+	if !ok || t.After(last) {
+		d.counted[id] = t
+		d.queue = append(d.queue, dedupEntry{id: id, counted: t})
+		d.unsaved++
+	}
+	return true
+}
+
+// expire forgets pairs counted before given time. Out-of-order pairs can be kept a bit longer, as pairs
+// are checked in order of counting.
+func (d *dedupSet) expire(before time.Time) {
+	for len(d.queue) > 0 && d.queue[0].counted.Before(before) {
+		d.pop()
+	}
+}
+
+// limit forgets the oldest counted pairs until no more than n left, zero n means no limit
+func (d *dedupSet) limit(n int) {
+	for n > 0 && len(d.counted) > n {
+		d.pop()
+	}
+}
+
+// pop removes the oldest entry of the queue, forgetting its pair unless it was counted again later
+func (d *dedupSet) pop() {
+	e := d.queue[0]
+	d.queue = d.queue[1:]
+	d.unsaved = min(d.unsaved, len(d.queue))
+	if last, ok := d.counted[e.id]; ok && last.Equal(e.counted) {
+		delete(d.counted, e.id)
+	}
+}
+
+// added returns pairs counted since the previous call in order of counting, pairs forgotten since then
+// are skipped, while pairs counted again are returned for every count
+func (d *dedupSet) added() []DedupKey {
+	res := make([]DedupKey, 0, d.unsaved)
+	for _, e := range d.queue[len(d.queue)-d.unsaved:] {
+		res = append(res, DedupKey{FromIP: e.id.ip, FileName: e.id.file, Counted: e.counted})
+	}
+	d.unsaved = 0
+	return res
+}
+
+// SaveDedup adds deduplication keys to stored ones, and removes stored keys counted before given time.
+// Keys start with time of counting, so expired ones are removed by a range of keys, and pairs counted again
+// are stored for every count.
+func (s *Bolt) SaveDedup(keys []DedupKey, before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dedupBucket)
+		for _, k := range keys {
+			if err := b.Put(dedupKey(k), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		maximum := dedupTime(before)
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, maximum) < 0; k, _ = c.Next() {
+			expired = append(expired, bytes.Clone(k))
+		}
+		// keys removed after iteration, as deletion under cursor makes it skip the next key
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadDedup loads stored deduplication keys counted since given time, ordered by time of counting
+func (s *Bolt) LoadDedup(since time.Time) (keys []DedupKey, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dedupBucket).Cursor()
+		for k, _ := c.Seek(dedupTime(since)); k != nil; k, _ = c.Next() {
+			if len(k) < 8 {
+				return fmt.Errorf("bad deduplication key %q", k)
+			}
+			// IP can't contain zero byte, so the rest of the key is split at the first one
+			ip, file, ok := strings.Cut(string(k[8:]), "\x00")
+			if !ok {
+				return fmt.Errorf("bad deduplication key %q", k)
+			}
+			keys = append(keys, DedupKey{FromIP: ip, FileName: file, Counted: time.Unix(int64(binary.BigEndian.Uint64(k)), 0)})
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// dedupKey returns storage key of deduplication key: time of counting, client IP and file
+func dedupKey(k DedupKey) []byte {
+	return append(append(append(dedupTime(k.Counted), k.FromIP...), 0), k.FileName...)
+}
+
+// dedupTime returns storage key prefix of given time, times before the epoch are stored as the epoch
+func dedupTime(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(max(t.Unix(), 0)))
+}
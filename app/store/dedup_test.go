@@ -0,0 +1,90 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupSet(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	first, second := dedupID{ip: "127.0.0.1", file: "rt_podcast561.mp3"}, dedupID{ip: "127.0.0.2", file: "rt_podcast561.mp3"}
+	d := dedupSet{}
+
+	assert.True(t, d.add(first, baseTime.Add(10*time.Minute), time.Hour))
+	assert.False(t, d.add(first, baseTime.Add(30*time.Minute), time.Hour), "within window")
+	assert.False(t, d.add(first, baseTime, time.Hour), "out of order within window")
+	assert.True(t, d.add(second, baseTime.Add(20*time.Minute), time.Hour))
+	assert.True(t, d.add(first, baseTime.Add(70*time.Minute), time.Hour), "after window")
+	assert.Len(t, d.queue, 3)
+	assert.Len(t, d.counted, 2)
+
+	d.expire(baseTime.Add(30 * time.Minute))
+	assert.Equal(t, map[dedupID]time.Time{first: baseTime.Add(70 * time.Minute)}, d.counted,
+		"stale entry of recounted pair doesn't forget it")
+
+	assert.True(t, d.add(second, baseTime.Add(80*time.Minute), time.Hour))
+	d.limit(1)
+	assert.Equal(t, map[dedupID]time.Time{second: baseTime.Add(80 * time.Minute)}, d.counted)
+	d.limit(0)
+	assert.Len(t, d.counted, 1, "zero limit keeps everything")
+}
+
+func TestDedupSet_Added(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	first, second := dedupID{ip: "127.0.0.1", file: "rt_podcast561.mp3"}, dedupID{ip: "127.0.0.2", file: "rt_podcast561.mp3"}
+	d := dedupSet{}
+
+	assert.True(t, d.add(first, baseTime, time.Hour))
+	assert.True(t, d.add(second, baseTime.Add(10*time.Minute), time.Hour))
+	assert.Equal(t, []DedupKey{
+		{FromIP: "127.0.0.1", FileName: "rt_podcast561.mp3", Counted: baseTime},
+		{FromIP: "127.0.0.2", FileName: "rt_podcast561.mp3", Counted: baseTime.Add(10 * time.Minute)},
+	}, d.added())
+	assert.Empty(t, d.added(), "nothing counted since the previous call")
+
+	assert.False(t, d.add(first, baseTime.Add(20*time.Minute), time.Hour))
+	assert.True(t, d.add(first, baseTime.Add(70*time.Minute), time.Hour))
+	assert.True(t, d.add(second, baseTime.Add(80*time.Minute), time.Hour))
+	d.limit(1)
+	assert.Equal(t, []DedupKey{{FromIP: "127.0.0.2", FileName: "rt_podcast561.mp3", Counted: baseTime.Add(80 * time.Minute)}}, d.added(),
+		"forgotten pairs are skipped")
+}
+
+func TestBolt_Dedup(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	keys, err := s.LoadDedup(time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, keys, "nothing saved yet")
+
+	baseTime := time.Unix(1704110400, 0)
+	saved := []DedupKey{
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", Counted: baseTime},
+		{FromIP: "::1", FileName: "/rtfiles/rt_podcast561.mp3", Counted: baseTime.Add(time.Minute)},
+		{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3", Counted: baseTime.Add(2 * time.Minute)},
+	}
+	require.NoError(t, s.SaveDedup(saved[:2], time.Time{}))
+	require.NoError(t, s.SaveDedup(saved[2:], time.Time{}))
+	keys, err = s.LoadDedup(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, saved, keys)
+
+	keys, err = s.LoadDedup(baseTime.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, saved[1:], keys, "keys counted before since are skipped")
+
+	recounted := DedupKey{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", Counted: baseTime.Add(3 * time.Minute)}
+	require.NoError(t, s.SaveDedup([]DedupKey{recounted}, baseTime.Add(2*time.Minute)))
+	keys, err = s.LoadDedup(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []DedupKey{saved[2], recounted}, keys, "keys counted before given time removed")
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	hllPrecision = 12                // bits of hash selecting a register, standard error is about 1.6%
+	hllRegisters = 1 << hllPrecision // number of registers in dense sketch
+	hllSparseMax = hllRegisters / 3  // max registers in sparse sketch, dense one is smaller beyond that
+	hllSparse    = byte(1)           // marshaled sketch format: register index and value pairs
+	hllDense     = byte(2)           // marshaled sketch format: all registers
+	hllAlpha     = 0.7213 / (1 + 1.079/hllRegisters)
+)
+
+// HLL is a HyperLogLog sketch estimating number of distinct values added to it. Sketches are mergeable, so a sketch
+// of a longer period is a merge of sketches of its parts. Sketch keeps only non-zero registers until it has
+// too many of them. Zero value is an empty sketch.
+type HLL struct {
+	sparse map[uint16]uint8 // non-zero registers by index, used while dense is nil
+	dense  []uint8          // all registers
+}
+
+// Add adds value to the sketch
+func (h *HLL) Add(value string) {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(value))
+	x := mix64(hash.Sum64())
+	idx := uint16(x >> (64 - hllPrecision))
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	h.set(idx, rank)
+}
+
+// Merge adds all values of other sketch to this one
+func (h *HLL) Merge(other *HLL) {
+	if other == nil {
+		return
+	}
+	if other.dense != nil {
+		for idx, rank := range other.dense {
+			if rank != 0 {
+				h.set(uint16(idx), rank)
+			}
+		}
+		return
+	}
+	for idx, rank := range other.sparse {
+		h.set(idx, rank)
+	}
+}
+
+// Clone returns a copy of the sketch
+func (h *HLL) Clone() *HLL {
+	res := &HLL{}
+	res.Merge(h)
+	return res
+}
+
+// Count returns estimated number of distinct values added to the sketch
+func (h *HLL) Count() int {
+	sum, zeros := 0.0, 0
+	if h.dense != nil {
+		for _, rank := range h.dense {
+			sum += math.Ldexp(1, -int(rank))
+			if rank == 0 {
+				zeros++
+			}
+		}
+	} else {
+		zeros = hllRegisters - len(h.sparse)
+		sum = float64(zeros)
+		for _, rank := range h.sparse {
+			sum += math.Ldexp(1, -int(rank))
+		}
+	}
+	estimate := hllAlpha * hllRegisters * hllRegisters / sum
+	if estimate <= 2.5*hllRegisters && zeros > 0 {
+		// linear counting is more precise for small cardinalities
+		estimate = hllRegisters * math.Log(float64(hllRegisters)/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// MarshalJSON encodes sketch as base64 string of format byte followed by sorted index and value pairs
+// for sparse sketch, or by all registers for dense one
+func (h *HLL) MarshalJSON() ([]byte, error) {
+	var b []byte
+	if h.dense != nil {
+		b = append([]byte{hllDense}, h.dense...)
+	} else {
+		idxs := make([]uint16, 0, len(h.sparse))
+		for idx := range h.sparse {
+			idxs = append(idxs, idx)
+		}
+		sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+		b = make([]byte, 1, 1+3*len(idxs))
+		b[0] = hllSparse
+		for _, idx := range idxs {
+			b = binary.BigEndian.AppendUint16(b, idx)
+			b = append(b, h.sparse[idx])
+		}
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes sketch encoded by MarshalJSON
+func (h *HLL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("bad sketch encoding: %w", err)
+	}
+	*h = HLL{}
+	switch {
+	case len(b) == 1+hllRegisters && b[0] == hllDense:
+		h.dense = append([]uint8{}, b[1:]...)
+	case len(b) > 0 && (len(b)-1)%3 == 0 && b[0] == hllSparse:
+		h.sparse = make(map[uint16]uint8, (len(b)-1)/3)
+		for i := 1; i < len(b); i += 3 {
+			idx, rank := binary.BigEndian.Uint16(b[i:]), b[i+2]
+			if int(idx) >= hllRegisters || rank == 0 {
+				return fmt.Errorf("bad sketch register %d", idx)
+			}
+			h.set(idx, rank)
+		}
+	default:
+		return errors.New("bad sketch format")
+	}
+	return nil
+}
+
+// set raises register to rank, switching sketch to dense form once sparse one has too many registers
+func (h *HLL) set(idx uint16, rank uint8) {
+	if h.dense != nil {
+		h.dense[idx] = max(h.dense[idx], rank)
+		return
+	}
+	if h.sparse == nil {
+		h.sparse = map[uint16]uint8{}
+	}
+	h.sparse[idx] = max(h.sparse[idx], rank)
+	if len(h.sparse) > hllSparseMax {
+		h.dense = make([]uint8, hllRegisters)
+		for i, r := range h.sparse {
+			h.dense[i] = r
+		}
+		h.sparse = nil
+	}
+}
+
+// mix64 is a finalizer of splitmix64, spreading FNV hash bits evenly
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLL_Count(t *testing.T) {
+	assert.Equal(t, 0, (&HLL{}).Count())
+
+	for _, n := range []int{1, 10, 100, 1000, 10000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			h := &HLL{}
+			for i := range n {
+				h.Add(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+				h.Add(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)) // duplicates are not counted
+			}
+			assert.InEpsilon(t, n, h.Count(), 0.05)
+			assert.Equal(t, n > hllSparseMax, h.dense != nil, "dense only with many values")
+		})
+	}
+}
+
+func TestHLL_Merge(t *testing.T) {
+	a, b := &HLL{}, &HLL{}
+	for i := range 3000 {
+		a.Add(fmt.Sprintf("a-%d", i))
+		b.Add(fmt.Sprintf("b-%d", i))
+	}
+	small := &HLL{}
+	small.Add("a-1")
+	small.Add("c-1")
+
+	merged := a.Clone()
+	merged.Merge(b)
+	merged.Merge(small)
+	merged.Merge(nil)
+	assert.InEpsilon(t, 6001, merged.Count(), 0.05)
+	assert.InEpsilon(t, 3000, a.Count(), 0.05, "source sketch not changed")
+
+	sparse := small.Clone()
+	sparse.Merge(small)
+	assert.Equal(t, 2, sparse.Count())
+	assert.Nil(t, sparse.dense)
+	sparse.Merge(a)
+	assert.NotNil(t, sparse.dense, "switched to dense form")
+	assert.InEpsilon(t, 3001, sparse.Count(), 0.05)
+}
+
+func TestHLL_JSON(t *testing.T) {
+	sparse, dense := &HLL{}, &HLL{}
+	sparse.Add("127.0.0.1")
+	sparse.Add("127.0.0.2")
+	for i := range 5000 {
+		dense.Add(fmt.Sprint(i))
+	}
+
+	for _, h := range []*HLL{{}, sparse, dense} {
+		data, err := json.Marshal(h)
+		require.NoError(t, err)
+		var decoded HLL
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, h.Count(), decoded.Count())
+		again, err := json.Marshal(&decoded)
+		require.NoError(t, err)
+		assert.Equal(t, string(data), string(again))
+	}
+
+	data, err := json.Marshal(sparse)
+	require.NoError(t, err)
+	assert.Len(t, data, 2+12, "two registers in sparse sketch are 7 bytes, 12 in base64")
+
+	for _, bad := range []string{`1`, `"!"`, `""`, `"AwAA"`, `"AQAAAA=="`, `"ARAAAQ=="`} {
+		var h HLL
+		assert.Error(t, json.Unmarshal([]byte(bad), &h), bad)
+	}
+}
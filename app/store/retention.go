@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactBatch limits number of candles processed in a single compaction transaction
+const compactBatch = 10000
+
+// Retention defines how long candles of each resolution are kept, zero value means forever.
+// Expired candles are still available with coarser resolution, as hourly and daily rollups
+// are updated on every save.
+type Retention struct {
+	Minute time.Duration // minute candles older than that are removed, whole hours only
+	Hour   time.Duration // hourly candles older than that are removed, whole days only
+	Day    time.Duration // daily candles older than that are removed
+}
+
+// CompactionStatus reports what was done by compaction since the start
+type CompactionStatus struct {
+	LastRun        time.Time      `json:"last_run"`
+	LastError      string         `json:"last_error,omitempty"`
+	Runs           int            `json:"runs"`
+	MinutesRemoved int            `json:"minutes_removed"` // expired minute candles
+	HoursRemoved   int            `json:"hours_removed"`   // expired hourly candles
+	DaysRemoved    int            `json:"days_removed"`    // expired daily candles
+	Candles        map[string]int `json:"candles"`         // number of stored candles by resolution
+}
+
+// RunCompaction compacts storage with given retention every interval until ctx is cancelled
+func (s *Bolt) RunCompaction(ctx context.Context, interval time.Duration, retention Retention) {
+	log.Printf("[INFO] compaction activated, every %v, %+v", interval, retention)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Compact(ctx, time.Now(), retention); err != nil {
+			log.Printf("[WARN] compaction failed, %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compact removes candles older than retention of their resolution. Minute candles are removed by whole hours
+// and hourly candles by whole days, so the period covered by each resolution is never split.
+func (s *Bolt) Compact(ctx context.Context, now time.Time, retention Retention) (err error) {
+	var removed [3]int
+	defer func() {
+		s.statusLock.Lock()
+		defer s.statusLock.Unlock()
+		s.status.LastRun = now
+		s.status.Runs++
+		s.status.MinutesRemoved += removed[0]
+		s.status.HoursRemoved += removed[1]
+		s.status.DaysRemoved += removed[2]
+		s.status.LastError = ""
+		if err != nil {
+			s.status.LastError = err.Error()
+		}
+	}()
+
+	tiers := []struct {
+		keep  time.Duration
+		whole time.Duration // candles removed by whole periods of the next resolution
+	}{{retention.Minute, time.Hour}, {retention.Hour, 24 * time.Hour}, {retention.Day, 24 * time.Hour}}
+	for i, tier := range tiers {
+		if tier.keep <= 0 {
+			continue
+		}
+		cutoff := now.Add(-tier.keep).Truncate(tier.whole)
+		if removed[i], err = s.expire(ctx, resolutions[i].bucket, cutoff); err != nil {
+			return fmt.Errorf("can't remove expired candles from %s: %w", resolutions[i].bucket, err)
+		}
+	}
+	if removed[0]+removed[1]+removed[2] > 0 {
+		log.Printf("[INFO] compaction done, removed minutes %d, hours %d, days %d", removed[0], removed[1], removed[2])
+	}
+	return nil
+}
+
+// CompactionStatus returns compaction results along with number of stored candles
+func (s *Bolt) CompactionStatus() (CompactionStatus, error) {
+	s.statusLock.Lock()
+	status := s.status
+	s.statusLock.Unlock()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		status.Candles = countCandles(tx)
+		return nil
+	})
+	return status, err
+}
+
+// countCandles returns number of stored candles by resolution name
+func countCandles(tx *bolt.Tx) map[string]int {
+	return map[string]int{
+		"minute": tx.Bucket(bucket).Stats().KeyN,
+		"hour":   tx.Bucket(hourlyBucket).Stats().KeyN,
+		"day":    tx.Bucket(dailyBucket).Stats().KeyN,
+	}
+}
+
+// expire removes candles started before cutoff from the bucket, returns number of removed candles.
+// Cutoff is recorded in metadata, so candles saved into the compacted period later don't extend the period
+// covered by the bucket.
+func (s *Bolt) expire(ctx context.Context, name []byte, cutoff time.Time) (count int, err error) {
+	maximum := fmt.Appendf(nil, "%d", cutoff.Unix())
+	for {
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		var keys [][]byte
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			c := tx.Bucket(name).Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, maximum) < 0 && len(keys) < compactBatch; k, _ = c.Next() {
+				keys = append(keys, bytes.Clone(k))
+			}
+			// keys removed after iteration, as deletion under cursor makes it skip the next key
+			for _, k := range keys {
+				if err := tx.Bucket(name).Delete(k); err != nil {
+					return err
+				}
+			}
+			if compactedBefore(tx, name) >= cutoff.Unix() {
+				return nil
+			}
+			return tx.Bucket(metaBucket).Put(compactedKey(name), maximum)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(keys)
+		if len(keys) < compactBatch {
+			return count, nil
+		}
+	}
+}
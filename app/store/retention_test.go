@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBolt_Compact(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// one candle every 10 minutes for 5 days, two downloads each
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for ts := start; ts.Before(start.Add(5 * 24 * time.Hour)); ts = ts.Add(10 * time.Minute) {
+		c := NewCandle()
+		c.Update(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: ts})
+		c.Update(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast562.mp3", DestHost: "n7.radio-t.com", Date: ts})
+		require.NoError(t, s.Save(c))
+	}
+	ctx := context.Background()
+	total := func(res time.Duration) (volume, candles int) {
+		loaded, lerr := loadResolution(ctx, s, start.Add(-time.Hour), start.Add(6*24*time.Hour), res)
+		require.NoError(t, lerr)
+		for i, c := range loaded {
+			volume += c.Nodes["all"].Volume
+			if i > 0 {
+				assert.True(t, loaded[i-1].StartMinute.Before(c.StartMinute), "ordered by time")
+			}
+		}
+		return volume, len(loaded)
+	}
+	volume, candles := total(time.Minute)
+	require.Equal(t, 5*24*6*2, volume)
+	require.Equal(t, 5*24*6, candles)
+
+	now := start.Add(5*24*time.Hour + 30*time.Minute)
+
+	// no retention configured, nothing changes
+	require.NoError(t, s.Compact(ctx, now, Retention{}))
+	_, candles = total(time.Minute)
+	assert.Equal(t, 5*24*6, candles)
+
+	// minutes older than 2 days removed, in the middle of the hour only whole hours removed
+	require.NoError(t, s.Compact(ctx, now, Retention{Minute: 2*24*time.Hour + 20*time.Minute}))
+	volume, candles = total(time.Minute)
+	assert.Equal(t, 5*24*6*2, volume, "volume preserved")
+	assert.Equal(t, 3*24+2*24*6, candles, "3 days of hours and 2 days of minutes")
+	status, err := s.CompactionStatus()
+	require.NoError(t, err)
+	assert.Equal(t, 3*24*6, status.MinutesRemoved)
+	assert.Equal(t, map[string]int{"minute": 2 * 24 * 6, "hour": 5 * 24, "day": 5}, status.Candles)
+
+	// hours older than 4 days removed
+	require.NoError(t, s.Compact(ctx, now, Retention{Minute: 2 * 24 * time.Hour, Hour: 4 * 24 * time.Hour}))
+	volume, candles = total(time.Minute)
+	assert.Equal(t, 5*24*6*2, volume, "volume preserved")
+	assert.Equal(t, 1+2*24+2*24*6, candles, "1 day, 2 days of hours and 2 days of minutes")
+
+	// hours may expire before minutes
+	require.NoError(t, s.Compact(ctx, now, Retention{Minute: 2 * 24 * time.Hour, Hour: 24 * time.Hour}))
+	volume, candles = total(time.Minute)
+	assert.Equal(t, 5*24*6*2, volume, "volume preserved")
+	assert.Equal(t, 3+2*24*6, candles, "3 days and 2 days of minutes")
+
+	// daily candles older than 4 days removed
+	require.NoError(t, s.Compact(ctx, now, Retention{Minute: 2 * 24 * time.Hour, Hour: 24 * time.Hour, Day: 4 * 24 * time.Hour}))
+	volume, candles = total(time.Minute)
+	assert.Equal(t, 4*24*6*2, volume, "first day removed")
+	assert.Equal(t, 2+2*24*6, candles)
+	volume, candles = total(time.Hour)
+	assert.Equal(t, 4*24*6*2, volume)
+	assert.Equal(t, 3+24, candles, "3 days and the last day of hours")
+
+	status, err = s.CompactionStatus()
+	require.NoError(t, err)
+	assert.Equal(t, 5, status.Runs)
+	assert.Equal(t, 3*24*6, status.MinutesRemoved)
+	assert.Equal(t, 4*24, status.HoursRemoved)
+	assert.Equal(t, 1, status.DaysRemoved)
+	assert.Equal(t, now, status.LastRun)
+	assert.Empty(t, status.LastError)
+
+	// cancelled context reported as error
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, s.Compact(cancelled, now, Retention{Minute: time.Hour}), context.Canceled)
+	status, err = s.CompactionStatus()
+	require.NoError(t, err)
+	assert.Contains(t, status.LastError, "context canceled")
+}
+
+func TestBolt_CompactThenSaveExpired(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	save := func(ts time.Time) {
+		c := NewCandle()
+		c.Update(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: ts})
+		require.NoError(t, s.Save(c))
+	}
+	for h := range 6 {
+		save(start.Add(time.Duration(h) * time.Hour))
+		save(start.Add(24*time.Hour + time.Duration(h)*time.Hour))
+	}
+	ctx := context.Background()
+	require.NoError(t, s.Compact(ctx, start.Add(2*24*time.Hour), Retention{Minute: 24 * time.Hour}))
+
+	// minute saved into the compacted day, like a replayed record, doesn't hide hourly rollups of the day
+	save(start.Add(30 * time.Minute))
+	loaded, err := s.Load(ctx, start, start.Add(2*24*time.Hour))
+	require.NoError(t, err)
+	volume := 0
+	for _, c := range loaded {
+		volume += c.Nodes["all"].Volume
+	}
+	assert.Equal(t, 13, volume)
+	assert.Len(t, loaded, 6+6, "hours of the compacted day and minutes of the next one")
+}
+
+func TestBolt_RunCompaction(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	c := NewCandle()
+	c.Update(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+		Date: time.Now().Add(-48 * time.Hour)})
+	require.NoError(t, s.Save(c))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.RunCompaction(ctx, 10*time.Millisecond, Retention{Minute: 24 * time.Hour})
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		status, serr := s.CompactionStatus()
+		return serr == nil && status.Runs >= 2 && status.MinutesRemoved == 1 && status.Candles["minute"] == 0
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
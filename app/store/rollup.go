@@ -0,0 +1,186 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// rollupsKey marks storage with hourly and daily rollups built for all stored candles
+var rollupsKey = []byte("rollups")
+
+// resolution defines bucket with candles of a given time span
+type resolution struct {
+	bucket []byte
+	span   time.Duration
+}
+
+// resolutions of stored candles, from the finest to the coarsest
+var resolutions = []resolution{
+	{bucket: bucket, span: time.Minute},
+	{bucket: hourlyBucket, span: time.Hour},
+	{bucket: dailyBucket, span: 24 * time.Hour},
+}
+
+// coveredSince returns unix time since which candles of i-th resolution are complete. Compaction removes
+// expired candles by whole periods of the next resolution, so the first stored candle truncated to that period
+// is the start of the covered time, unless it was saved into the already compacted period, which is recorded
+// by compaction. Empty bucket covers nothing, the coarsest one covers everything.
+func coveredSince(tx *bolt.Tx, i int) int64 {
+	if i == len(resolutions)-1 {
+		return math.MinInt64
+	}
+	k, _ := tx.Bucket(resolutions[i].bucket).Cursor().First()
+	if k == nil {
+		return math.MaxInt64
+	}
+	first, err := strconv.ParseInt(string(k), 10, 64)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return max(time.Unix(first, 0).Truncate(resolutions[i+1].span).Unix(), compactedBefore(tx, resolutions[i].bucket))
+}
+
+// coverage plans which resolutions cover the period, as segments of candles ordered by time. Times are unix
+// seconds, segment covers candles started within its bounds, both inclusive.
+type coverage struct {
+	covered  []int64 // coveredSince of every resolution
+	segments []coverageSegment
+}
+
+// coverageSegment is a range of candle start times read from the bucket of res-th resolution
+type coverageSegment struct {
+	res      int
+	from, to int64
+}
+
+// exact covers minutes started within [from, to] with candles of i-th resolution, candles which would reach
+// beyond the bounds are replaced by finer ones. Minutes before coverage of the resolution are covered by
+// coarser candles, as the finer ones expired even earlier.
+func (p *coverage) exact(from, to int64, i int) {
+	if from > to {
+		return
+	}
+	if from < p.covered[i] {
+		p.whole(from, min(to, p.covered[i]-1), i+1)
+		from = p.covered[i]
+		if from > to {
+			return
+		}
+	}
+	if i == 0 {
+		p.segments = append(p.segments, coverageSegment{res: 0, from: from, to: to})
+		return
+	}
+
+	span := int64(resolutions[i].span / time.Second)
+	first, last := ceilTo(from, span), floorTo(to-span+60, span) // candles started and ended within the bounds
+	if first > last {
+		p.exact(from, to, i-1)
+		return
+	}
+	p.exact(from, first-1, i-1)
+	p.segments = append(p.segments, coverageSegment{res: i, from: first, to: last})
+	p.exact(last+span, to, i-1)
+}
+
+// whole covers minutes started within [from, to] with whole candles of i-th or coarser resolution, including
+// the candle started before from. Coverage of a finer resolution starts at the beginning of the coarser period,
+// so such candles never overlap finer ones.
+func (p *coverage) whole(from, to int64, i int) {
+	if from < p.covered[i] {
+		p.whole(from, min(to, p.covered[i]-1), i+1)
+		from = p.covered[i]
+		if from > to {
+			return
+		}
+	}
+	p.segments = append(p.segments, coverageSegment{res: i, from: floorTo(from, int64(resolutions[i].span/time.Second)), to: to})
+}
+
+// floorTo rounds unix time t down to a multiple of span seconds
+func floorTo(t, span int64) int64 {
+	r := t % span
+	if r < 0 {
+		r += span
+	}
+	return t - r
+}
+
+// ceilTo rounds unix time t up to a multiple of span seconds
+func ceilTo(t, span int64) int64 {
+	return -floorTo(-t, span)
+}
+
+// compactedBefore returns unix time before which candles of the bucket were removed by compaction,
+// math.MinInt64 if the bucket was never compacted
+func compactedBefore(tx *bolt.Tx, name []byte) int64 {
+	v := tx.Bucket(metaBucket).Get(compactedKey(name))
+	if v == nil {
+		return math.MinInt64
+	}
+	res, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return math.MinInt64
+	}
+	return res
+}
+
+// compactedKey returns meta key of the time before which candles of the bucket were removed by compaction
+func compactedKey(name []byte) []byte {
+	return append([]byte("compacted_"), name...)
+}
+
+// buildRollups fills hourly and daily rollups from stored candles, does nothing if rollups were built already.
+// Needed for storages created before rollups were maintained on save.
+func buildRollups(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if meta.Get(rollupsKey) != nil {
+		return nil
+	}
+	// hourly candles of compacted periods are not in daily candles yet
+	if err := rollupBucket(tx, hourlyBucket, resolutions[2]); err != nil {
+		return err
+	}
+	for _, r := range resolutions[1:] {
+		if err := rollupBucket(tx, bucket, r); err != nil {
+			return err
+		}
+	}
+	return meta.Put(rollupsKey, []byte(time.Now().Format(time.RFC3339)))
+}
+
+// rollupBucket merges all candles of src bucket into candles of dst resolution
+func rollupBucket(tx *bolt.Tx, src []byte, dst resolution) error {
+	var current *Candle
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		return mergeCandle(tx.Bucket(dst.bucket), *current, 0, 0)
+	}
+
+	c := tx.Bucket(src).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		candle := Candle{}
+		if err := json.Unmarshal(v, &candle); err != nil {
+			return fmt.Errorf("can't decode candle %s: %w", k, err)
+		}
+		start := candle.StartMinute.Truncate(dst.span)
+		if current != nil && !current.StartMinute.Equal(start) {
+			if err := flush(); err != nil {
+				return err
+			}
+			current = nil
+		}
+		if current == nil {
+			current = &Candle{Nodes: map[string]Info{}, StartMinute: start}
+		}
+		current.Merge(candle)
+	}
+	return flush()
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBolt_IterateResolution(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// one download every 15 minutes for 2 days
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for ts := start; ts.Before(start.Add(48 * time.Hour)); ts = ts.Add(15 * time.Minute) {
+		c := NewCandle()
+		c.Update(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: ts})
+		require.NoError(t, s.Save(c))
+	}
+
+	ctx := context.Background()
+	to := start.Add(48*time.Hour - time.Second)
+	tbl := []struct {
+		res     time.Duration
+		candles int
+		span    time.Duration
+	}{
+		{res: time.Second, candles: 48 * 4, span: 15 * time.Minute},
+		{res: time.Minute, candles: 48 * 4, span: 15 * time.Minute},
+		{res: 5 * time.Minute, candles: 48, span: time.Hour},
+		{res: time.Hour, candles: 48, span: time.Hour},
+		{res: 24 * time.Hour, candles: 2, span: 24 * time.Hour},
+		{res: 7 * 24 * time.Hour, candles: 2, span: 24 * time.Hour},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.res.String(), func(t *testing.T) {
+			res, err := loadResolution(ctx, s, start, to, tt.res)
+			require.NoError(t, err)
+			require.Len(t, res, tt.candles)
+			var volume int
+			for i, c := range res {
+				assert.Equal(t, start.Add(time.Duration(i)*tt.span), c.StartMinute.UTC())
+				volume += c.Nodes["n6.radio-t.com"].Volume
+				assert.Equal(t, c.Nodes["all"].Volume, c.Nodes["all"].Files["/rtfiles/rt_podcast561.mp3"])
+			}
+			assert.Equal(t, 48*4, volume)
+		})
+	}
+
+	// partial hours at the edges of the period are read from minute candles
+	res, err := loadResolution(ctx, s, start.Add(23*time.Hour), start.Add(23*time.Hour+time.Minute), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, start.Add(23*time.Hour), res[0].StartMinute.UTC())
+	assert.Equal(t, 1, res[0].Nodes["all"].Volume)
+
+	res, err = loadResolution(ctx, s, start.Add(23*time.Hour+30*time.Minute), start.Add(25*time.Hour+15*time.Minute), time.Hour)
+	require.NoError(t, err)
+	var starts []time.Time
+	for _, c := range res {
+		starts = append(starts, c.StartMinute.UTC())
+	}
+	assert.Equal(t, []time.Time{start.Add(23*time.Hour + 30*time.Minute), start.Add(23*time.Hour + 45*time.Minute),
+		start.Add(24 * time.Hour), start.Add(25 * time.Hour), start.Add(25*time.Hour + 15*time.Minute)}, starts)
+	assert.Equal(t, 4, res[2].Nodes["all"].Volume, "whole hour within the period")
+
+	// whole day within the period is read from daily candle, and the rest from hourly and minute candles
+	res, err = loadResolution(ctx, s, start.Add(22*time.Hour+45*time.Minute), start.Add(48*time.Hour), 24*time.Hour)
+	require.NoError(t, err)
+	starts = nil
+	for _, c := range res {
+		starts = append(starts, c.StartMinute.UTC())
+	}
+	assert.Equal(t, []time.Time{start.Add(22*time.Hour + 45*time.Minute), start.Add(23 * time.Hour), start.Add(24 * time.Hour)}, starts)
+}
+
+func TestBolt_BuildRollups(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	s, err := NewBolt(file.Name())
+	require.NoError(t, err)
+
+	// storage without rollups: hourly candles for compacted first day, minute candles for the second one
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	put := func(tx *bolt.Tx, name []byte, ts time.Time) error {
+		c := NewCandle()
+		c.Update(LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: ts})
+		data, jerr := json.Marshal(c)
+		if jerr != nil {
+			return jerr
+		}
+		return tx.Bucket(name).Put(fmt.Appendf(nil, "%d", ts.Unix()), data)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for ts := start; ts.Before(start.Add(24 * time.Hour)); ts = ts.Add(time.Hour) {
+			if e := put(tx, hourlyBucket, ts); e != nil {
+				return e
+			}
+		}
+		for ts := start.Add(24 * time.Hour); ts.Before(start.Add(48 * time.Hour)); ts = ts.Add(30 * time.Minute) {
+			if e := put(tx, bucket, ts); e != nil {
+				return e
+			}
+		}
+		return tx.Bucket(metaBucket).Delete(rollupsKey)
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = NewBolt(file.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	ctx := context.Background()
+	days, err := loadResolution(ctx, s, start, start.Add(48*time.Hour), 24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, days, 2)
+	assert.Equal(t, 24, days[0].Nodes["all"].Volume)
+	assert.Equal(t, 48, days[1].Nodes["all"].Volume)
+
+	hours, err := loadResolution(ctx, s, start, start.Add(48*time.Hour), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, hours, 48)
+	assert.Equal(t, 1, hours[0].Nodes["all"].Volume)
+	assert.Equal(t, 2, hours[47].Nodes["all"].Volume)
+
+	minutes, err := s.Load(ctx, start, start.Add(48*time.Hour))
+	require.NoError(t, err)
+	assert.Len(t, minutes, 24+48, "hours for the first day, minutes for the second")
+
+	// rollups are built only once
+	require.NoError(t, s.db.Update(buildRollups))
+	days, err = loadResolution(ctx, s, start, start.Add(48*time.Hour), 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 24, days[0].Nodes["all"].Volume)
+}
+
+// loadResolution collects candles of given resolution returned by Iterate
+func loadResolution(ctx context.Context, s *Bolt, periodStart, periodEnd time.Time, resolution time.Duration) ([]Candle, error) {
+	res := []Candle{}
+	err := s.Iterate(ctx, periodStart, periodEnd, resolution, func(c Candle) error {
+		res = append(res, c)
+		return nil
+	})
+	return res, err
+}
@@ -9,4 +9,7 @@ import (
 type Engine interface {
 	Save(candle Candle) (err error)
 	Load(ctx context.Context, periodStart, periodEnd time.Time) (result []Candle, err error)
+	// Iterate calls fn for candles of given resolution covering the period without loading all of them into memory,
+	// stops on the first error returned by fn
+	Iterate(ctx context.Context, periodStart, periodEnd time.Time, resolution time.Duration, fn func(Candle) error) error
 }
@@ -1,64 +1,69 @@
 package web
 
 import (
-	"context"
+	"sort"
 	"time"
 
 	"github.com/umputun/rlb-stats/app/store"
 )
 
-// aggregateCandles takes candles from input, and aggregate them by aggInterval truncated to minutes
-func aggregateCandles(ctx context.Context, candles []store.Candle, aggInterval time.Duration) []store.Candle {
-	// initialize result in this way to return empty slice instead of nil for empty result
-	result := []store.Candle{}
+// bucketAggregator merges candles into intervals one by one, so candles don't have to be loaded at once
+type bucketAggregator struct {
+	bucket  func(t time.Time) (n int64, start time.Time) // interval number and start for candle StartMinute
+	buckets map[int64]int                                // interval number to position in result
+	result  []store.Candle
+}
 
-	// protect against less than 1m interval truncated to zero
-	if aggInterval < time.Minute {
-		aggInterval = time.Minute
-	}
-	aggInterval = aggInterval.Truncate(time.Minute)
+// newBucketAggregator makes aggregator with given intervals
+func newBucketAggregator(bucket func(t time.Time) (int64, time.Time)) *bucketAggregator {
+	return &bucketAggregator{bucket: bucket, buckets: map[int64]int{}, result: []store.Candle{}}
+}
 
-	var firstDate, lastDate = time.Now(), time.Time{}
-	for _, c := range candles {
-		if c.StartMinute.Before(firstDate) {
-			firstDate = c.StartMinute
-		}
-		if c.StartMinute.After(lastDate) {
-			lastDate = c.StartMinute
-		}
-	}
+// newDurationAggregator makes aggregator by aggInterval truncated to minutes. Intervals are aligned to from
+// truncated to minute, each candle goes to the interval its StartMinute falls into.
+func newDurationAggregator(from time.Time, aggInterval time.Duration) *bucketAggregator {
+	aggInterval = durationInterval(aggInterval)
+	from = from.Truncate(time.Minute)
 
-	for aggTime := firstDate; aggTime.Before(lastDate.Add(aggInterval)); aggTime = aggTime.Add(aggInterval) {
-		select {
-		case <-ctx.Done():
-			return result
-		default:
-		}
-		minuteCandle := store.NewCandle()
-		minuteCandle.StartMinute = aggTime
-		for _, c := range candles {
-			if c.StartMinute.Equal(aggTime) || c.StartMinute.After(aggTime) && c.StartMinute.Before(aggTime.Add(aggInterval)) {
-				c = updateCandleAndDiscardTime(minuteCandle, c)
-			}
-		}
-		if len(minuteCandle.Nodes) != 0 {
-			result = append(result, minuteCandle)
+	return newBucketAggregator(func(t time.Time) (int64, time.Time) {
+		offset := t.Sub(from)
+		n := int64(offset / aggInterval)
+		if offset < 0 && offset%aggInterval != 0 {
+			n-- // candles before from go to intervals aligned the same way
 		}
+		return n, from.Add(time.Duration(n) * aggInterval).In(t.Location())
+	})
+}
+
+// durationInterval returns aggregation interval used for duration, truncated to minutes. Intervals less than
+// a minute are rounded up to a minute, so they are not truncated to zero.
+func durationInterval(d time.Duration) time.Duration {
+	return max(d, time.Minute).Truncate(time.Minute)
+}
+
+// add merges candle into its interval
+func (b *bucketAggregator) add(c store.Candle) {
+	n, start := b.bucket(c.StartMinute)
+	pos, ok := b.buckets[n]
+	if !ok {
+		aggCandle := store.NewCandle()
+		aggCandle.StartMinute = start
+		b.result = append(b.result, aggCandle)
+		pos = len(b.result) - 1
+		b.buckets[n] = pos
 	}
-	return result
+	b.result[pos].Merge(c)
 }
 
-func updateCandleAndDiscardTime(source store.Candle, appendix store.Candle) store.Candle {
-	for n := range appendix.Nodes {
-		m, ok := source.Nodes[n]
-		if !ok {
-			m = store.NewInfo()
-		}
-		for file := range appendix.Nodes[n].Files {
-			m.Files[file] += appendix.Nodes[n].Files[file]
+// candles returns aggregated candles ordered by time. Intervals of candles without nodes are dropped,
+// the same as intervals without candles.
+func (b *bucketAggregator) candles() []store.Candle {
+	result := []store.Candle{}
+	for _, c := range b.result {
+		if len(c.Nodes) != 0 || len(c.Requests) != 0 { // all requests of interval can be duplicates
+			result = append(result, c)
 		}
-		m.Volume += appendix.Nodes[n].Volume
-		source.Nodes[n] = m
 	}
-	return source
+	sort.Slice(result, func(i, j int) bool { return result[i].StartMinute.Before(result[j].StartMinute) })
+	return result
 }
@@ -1,11 +1,12 @@
 package web
 
 import (
-	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/rlb-stats/app/store"
 )
@@ -127,10 +128,74 @@ var resultCandles = map[int][]store.Candle{
 
 func TestAggregation(t *testing.T) {
 	for i, result := range resultCandles {
-		testSlice := aggregateCandles(context.Background(), testCandles, time.Duration(i)*time.Minute)
+		testSlice := aggregate(newDurationAggregator(time.Time{}, time.Duration(i)*time.Minute), testCandles)
 		assert.EqualValues(t, result, testSlice, "candle aggregate for %v minutes match with expected output", i)
 	}
 	// test less than 1 minute period which should have same output as 1 minute aggregation
-	testSlice := aggregateCandles(context.Background(), testCandles, time.Nanosecond)
+	testSlice := aggregate(newDurationAggregator(time.Time{}, time.Nanosecond), testCandles)
 	assert.EqualValues(t, testCandles, testSlice, "candle aggregate for 1 nanosecond match with expected output")
 }
+
+func TestAggregationAlignedToFrom(t *testing.T) {
+	// intervals start from the requested time, not from the first candle
+	res := aggregate(newDurationAggregator(time.Time{}.Add(-time.Minute), 5*time.Minute), testCandles)
+	require.Len(t, res, 3)
+	assert.Equal(t, time.Time{}.Add(-time.Minute), res[0].StartMinute)
+	assert.Equal(t, 4, res[0].Nodes["all"].Volume, "minutes 0-3")
+	assert.Equal(t, time.Time{}.Add(4*time.Minute), res[1].StartMinute)
+	assert.Equal(t, 2, res[1].Nodes["all"].Volume, "minutes 4-5")
+	assert.Equal(t, time.Time{}.Add(9*time.Minute), res[2].StartMinute)
+	assert.Equal(t, 1, res[2].Nodes["all"].Volume, "minute 10")
+
+	// seconds of from are dropped
+	res = aggregate(newDurationAggregator(time.Time{}.Add(30*time.Second), 10*time.Minute), testCandles)
+	require.Len(t, res, 2)
+	assert.Equal(t, time.Time{}, res[0].StartMinute)
+	assert.Equal(t, time.Time{}.Add(10*time.Minute), res[1].StartMinute)
+
+	// candles before from go to intervals aligned to from, result ordered regardless of input order
+	unordered := []store.Candle{testCandles[6], testCandles[0], testCandles[3]}
+	res = aggregate(newDurationAggregator(time.Time{}.Add(2*time.Minute), 3*time.Minute), unordered)
+	require.Len(t, res, 3)
+	assert.Equal(t, time.Time{}.Add(-time.Minute), res[0].StartMinute)
+	assert.Equal(t, time.Time{}.Add(2*time.Minute), res[1].StartMinute)
+	assert.Equal(t, time.Time{}.Add(8*time.Minute), res[2].StartMinute)
+
+	// empty input and future period
+	assert.Equal(t, []store.Candle{}, aggregate(newDurationAggregator(time.Now().Add(time.Hour), time.Hour), nil))
+	assert.Equal(t, []store.Candle{}, aggregate(newDurationAggregator(time.Time{}, time.Hour), []store.Candle{store.NewCandle()}))
+}
+
+// monthOfCandles makes minute candles for 30 days with a few nodes and files in each
+func monthOfCandles(from time.Time) []store.Candle {
+	candles := make([]store.Candle, 0, 30*24*60)
+	for ts := from; ts.Before(from.Add(30 * 24 * time.Hour)); ts = ts.Add(time.Minute) {
+		c := store.NewCandle()
+		for i := range 5 {
+			c.Update(store.LogRecord{FromIP: "127.0.0.1", FileName: fmt.Sprintf("/rtfiles/rt_podcast%d.mp3", 560+i),
+				DestHost: fmt.Sprintf("n%d.radio-t.com", 6+i%2), Date: ts})
+		}
+		candles = append(candles, c)
+	}
+	return candles
+}
+
+func BenchmarkDurationAggregator(b *testing.B) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	candles := monthOfCandles(from)
+	for _, interval := range []time.Duration{time.Hour, 30 * 24 * time.Hour / 100, 24 * time.Hour} {
+		b.Run(interval.String(), func(b *testing.B) {
+			for b.Loop() {
+				aggregate(newDurationAggregator(from, interval), candles)
+			}
+		})
+	}
+}
+
+// aggregate adds candles to aggregator one by one and returns the aggregated candles
+func aggregate(agg *bucketAggregator, candles []store.Candle) []store.Candle {
+	for _, c := range candles {
+		agg.add(c)
+	}
+	return agg.candles()
+}
@@ -0,0 +1,46 @@
+package web
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// asnReport contains top autonomous systems by downloads for a period
+type asnReport struct {
+	From   time.Time  `json:"from"`
+	To     time.Time  `json:"to"`
+	Volume int        `json:"volume"` // downloads with known autonomous system
+	ASNs   []asnCount `json:"asns"`   // top autonomous systems, ordered by count
+}
+
+// asnCount contains downloads from a single autonomous system
+type asnCount struct {
+	ASN          string  `json:"asn"` // like AS64512
+	Organization string  `json:"organization"`
+	Count        int     `json:"count"`
+	Percent      float64 `json:"percent"` // share of the autonomous system in downloads with known one
+}
+
+// loadASNs sums up downloads by autonomous system for [from, to) period and returns up to limit top ones
+func loadASNs(ctx context.Context, engine store.Engine, from, to time.Time, limit int) (asnReport, error) {
+	total, err := sumDimensions(ctx, engine, from, to, func(c store.Candle) store.Candle {
+		return store.Candle{ASNs: c.ASNs}
+	})
+	if err != nil {
+		return asnReport{}, err
+	}
+
+	res := asnReport{From: from, To: to, ASNs: []asnCount{}}
+	for _, count := range total.ASNs {
+		res.Volume += count
+	}
+	for _, a := range store.TopCounts(total.ASNs, limit) {
+		asn, org, _ := strings.Cut(a.Key, " ")
+		res.ASNs = append(res.ASNs, asnCount{ASN: asn, Organization: org, Count: a.Count,
+			Percent: 100 * float64(a.Count) / float64(res.Volume)})
+	}
+	return res, nil
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/geo"
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// mockASNLocator finds autonomous systems of IPs by the table, other IPs are not found
+type mockASNLocator map[string]geo.ASN
+
+func (m mockASNLocator) ASN(ip string) (geo.ASN, error) {
+	return m[ip], nil
+}
+
+func TestLoadASNs(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := &goodDB{saved: []store.Candle{
+		{Nodes: storedCandle.Nodes, StartMinute: from, ASNs: map[string]int{"AS64512 Test Net": 3, "AS64513 Other Net": 1}},
+		{Nodes: storedCandle.Nodes, StartMinute: from.Add(time.Hour)}, // stored without autonomous systems
+		{Nodes: storedCandle.Nodes, StartMinute: from.Add(2 * time.Hour), ASNs: map[string]int{"AS64514": 2, "AS64513 Other Net": 2}},
+	}}
+
+	res, err := loadASNs(context.Background(), db, from, from.Add(3*time.Hour), 2)
+	require.NoError(t, err)
+	assert.Equal(t, asnReport{From: from, To: from.Add(3 * time.Hour), Volume: 8, ASNs: []asnCount{
+		{ASN: "AS64512", Organization: "Test Net", Count: 3, Percent: 37.5},
+		{ASN: "AS64513", Organization: "Other Net", Count: 3, Percent: 37.5},
+	}}, res)
+	assert.Equal(t, []time.Duration{time.Hour}, db.resolutions, "hourly rollups for whole hours")
+
+	res, err = loadASNs(context.Background(), db, from, from.Add(3*time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, res.ASNs, 3)
+	assert.Equal(t, asnCount{ASN: "AS64514", Count: 2, Percent: 25}, res.ASNs[2], "no organization")
+}
+
+func TestServerInsertASN(t *testing.T) {
+	aggregator := &store.Aggregator{}
+	srv := &Server{Engine: &goodDB{}, Aggregator: aggregator,
+		ASN: mockASNLocator{"192.168.1.1": {Number: 64512, Organization: "Test Net"}, "192.168.1.2": {Number: 64512, Organization: "Test Net"}}}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, ip := range []string{"192.168.1.1", "192.168.1.2", "127.0.0.1"} {
+		resp, err := http.Post(ts.URL+"/api/insert", "application/json", strings.NewReader(
+			`{"from_ip":"`+ip+`","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode, ip)
+	}
+	candles := aggregator.Flush()
+	require.Len(t, candles, 1)
+	assert.Equal(t, map[string]int{"AS64512 Test Net": 2}, candles[0].ASNs)
+	assert.Nil(t, candles[0].Countries, "no geoip database")
+}
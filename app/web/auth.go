@@ -0,0 +1,144 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+const (
+	signatureHeader = "X-Rlb-Signature" // hex encoded HMAC-SHA256 of timestamp, dot and body, keyed by node token
+	timestampHeader = "X-Rlb-Timestamp" // unix time of signing, in seconds
+	maxSignedBody   = 32 * 1024 * 1024  // signed body is read into memory to check signature
+)
+
+// errForbiddenDest returned for log record reported by node other than the record's dest
+var errForbiddenDest = errors.New("dest doesn't match token")
+
+// InsertAuth authenticates nodes inserting log records by bearer tokens, optionally with HMAC signed bodies.
+// Safe for concurrent use.
+type InsertAuth struct {
+	HMAC    bool          // require bodies signed with node token
+	MaxSkew time.Duration // max difference between signature timestamp and server time
+
+	tokens map[string]string // node by token
+
+	mu    sync.Mutex
+	seen  map[string]struct{} // signatures of accepted requests
+	queue []seenSignature     // accepted signatures in order of acceptance
+}
+
+// seenSignature is a signature of accepted request with time it can be forgotten
+type seenSignature struct {
+	signature string
+	expires   time.Time
+}
+
+// NewInsertAuth makes InsertAuth from tokens in node:token format, node can have multiple tokens
+func NewInsertAuth(tokens []string, signed bool, maxSkew time.Duration) (*InsertAuth, error) {
+	res := &InsertAuth{HMAC: signed, MaxSkew: maxSkew, tokens: map[string]string{}, seen: map[string]struct{}{}}
+	for _, t := range tokens {
+		i := strings.LastIndex(t, ":")
+		if i <= 0 || i == len(t)-1 {
+			return nil, fmt.Errorf("bad token %q, should be node:token", t)
+		}
+		if node, ok := res.tokens[t[i+1:]]; ok && node != t[:i] {
+			return nil, fmt.Errorf("token of node %q is used by node %q too", t[:i], node)
+		}
+		res.tokens[t[i+1:]] = t[:i]
+	}
+	return res, nil
+}
+
+// authenticate returns node of the request's bearer token. With HMAC enabled, request body is read and checked
+// against signature, which is accepted only once within MaxSkew from its timestamp, and r.Body is replaced
+// with the read body.
+func (a *InsertAuth) authenticate(r *http.Request, now time.Time) (node string, err error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("no bearer token")
+	}
+	for t, n := range a.tokens { // all tokens compared to keep the time constant
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			node = n
+		}
+	}
+	if node == "" {
+		return "", errors.New("unknown token")
+	}
+	if !a.HMAC {
+		return node, nil
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad %s header: %w", timestampHeader, err)
+	}
+	signedAt := time.Unix(ts, 0)
+	if signedAt.Before(now.Add(-a.MaxSkew)) || signedAt.After(now.Add(a.MaxSkew)) {
+		return "", fmt.Errorf("signature timestamp %v is out of allowed skew %v", signedAt, a.MaxSkew)
+	}
+	signature, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil {
+		return "", fmt.Errorf("bad %s header: %w", signatureHeader, err)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return "", fmt.Errorf("can't read body: %w", err)
+	}
+	if len(body) > maxSignedBody {
+		return "", errors.New("signed body is too large")
+	}
+	if !hmac.Equal(signature, signBody(token, ts, body)) {
+		return "", errors.New("bad signature")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// signatures are forgotten in order of acceptance, so the one signed earlier but accepted later can be kept
+	// a bit longer, up to MaxSkew, and is still rejected as out of skew then
+	for len(a.queue) > 0 && now.After(a.queue[0].expires) {
+		delete(a.seen, a.queue[0].signature)
+		a.queue = a.queue[1:]
+	}
+	key := string(signature)
+	if _, replayed := a.seen[key]; replayed {
+		return "", errors.New("signature already used")
+	}
+	a.seen[key] = struct{}{}
+	a.queue = append(a.queue, seenSignature{signature: key, expires: signedAt.Add(a.MaxSkew)})
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return node, nil
+}
+
+// signBody returns HMAC-SHA256 of timestamp, dot and body, keyed by token
+func signBody(token string, ts int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	_, _ = fmt.Fprintf(mac, "%d.", ts)
+	_, _ = mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// nodeKey is a context key for node authenticated by InsertAuth
+type nodeKey struct{}
+
+// checkDest returns errForbiddenDest if request was authenticated for node other than dest of the record
+func checkDest(ctx context.Context, l store.LogRecord) error {
+	if node, ok := ctx.Value(nodeKey{}).(string); ok && node != l.DestHost {
+		return errForbiddenDest
+	}
+	return nil
+}
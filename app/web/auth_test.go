@@ -0,0 +1,141 @@
+package web
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestNewInsertAuth(t *testing.T) {
+	auth, err := NewInsertAuth([]string{"n6.radio-t.com:secret6", "n6.radio-t.com:other6", "n7:8080:secret7"}, false, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"secret6": "n6.radio-t.com", "other6": "n6.radio-t.com", "secret7": "n7:8080"}, auth.tokens)
+
+	for _, bad := range []string{"secret", ":secret", "n6.radio-t.com:"} {
+		_, err = NewInsertAuth([]string{bad}, false, time.Minute)
+		assert.Error(t, err, bad)
+	}
+
+	_, err = NewInsertAuth([]string{"n6.radio-t.com:secret6", "n7.radio-t.com:secret6"}, false, time.Minute)
+	assert.EqualError(t, err, `token of node "n7.radio-t.com" is used by node "n6.radio-t.com" too`)
+	_, err = NewInsertAuth([]string{"n6.radio-t.com:secret6", "n6.radio-t.com:secret6"}, false, time.Minute)
+	assert.NoError(t, err, "repeated token of the same node")
+}
+
+func TestInsertAuth_Authenticate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	body := `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`
+	request := func(token string, ts time.Time, signature []byte) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/insert", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if signature != nil {
+			r.Header.Set(timestampHeader, strconv.FormatInt(ts.Unix(), 10))
+			r.Header.Set(signatureHeader, hex.EncodeToString(signature))
+		}
+		return r
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		auth, err := NewInsertAuth([]string{"n6.radio-t.com:secret6", "n7.radio-t.com:secret7"}, false, time.Minute)
+		require.NoError(t, err)
+		node, err := auth.authenticate(request("secret7", now, nil), now)
+		require.NoError(t, err)
+		assert.Equal(t, "n7.radio-t.com", node)
+
+		_, err = auth.authenticate(request("", now, nil), now)
+		assert.EqualError(t, err, "no bearer token")
+		_, err = auth.authenticate(request("secret", now, nil), now)
+		assert.EqualError(t, err, "unknown token")
+	})
+
+	t.Run("signed body", func(t *testing.T) {
+		auth, err := NewInsertAuth([]string{"n6.radio-t.com:secret6"}, true, time.Minute)
+		require.NoError(t, err)
+		signature := signBody("secret6", now.Unix(), []byte(body))
+
+		r := request("secret6", now, signature)
+		node, err := auth.authenticate(r, now.Add(30*time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, "n6.radio-t.com", node)
+		readBody, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(readBody), "body available after check")
+
+		_, err = auth.authenticate(request("secret6", now, signature), now.Add(30*time.Second))
+		assert.EqualError(t, err, "signature already used")
+
+		_, err = auth.authenticate(request("secret6", now, nil), now)
+		assert.ErrorContains(t, err, "bad X-Rlb-Timestamp header")
+		_, err = auth.authenticate(request("secret6", now, signBody("secret7", now.Unix(), []byte(body))), now)
+		assert.EqualError(t, err, "bad signature")
+		_, err = auth.authenticate(request("secret6", now.Add(time.Second), signature), now)
+		assert.EqualError(t, err, "bad signature", "timestamp is signed")
+		_, err = auth.authenticate(request("secret6", now, signature), now.Add(2*time.Minute))
+		assert.ErrorContains(t, err, "out of allowed skew")
+
+		// signatures out of allowed skew are forgotten
+		late := now.Add(time.Hour)
+		lateSignature := signBody("secret6", late.Unix(), []byte(body))
+		_, err = auth.authenticate(request("secret6", late, lateSignature), late)
+		require.NoError(t, err)
+		assert.Len(t, auth.seen, 1)
+		assert.Len(t, auth.queue, 1)
+	})
+}
+
+func TestServerInsertAuth(t *testing.T) {
+	auth, err := NewInsertAuth([]string{"n6.radio-t.com:secret6"}, false, time.Minute)
+	require.NoError(t, err)
+	srv := &Server{Engine: &goodDB{}, Aggregator: &store.Aggregator{}, InsertAuth: auth}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	tbl := []struct {
+		url, token, body string
+		code             int
+		result           string
+	}{
+		{url: "/api/insert", token: "secret6", code: http.StatusOK,
+			body:   `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`,
+			result: `{"result":"ok"}` + "\n"},
+		{url: "/api/insert", token: "secret6", code: http.StatusForbidden,
+			body:   `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n7.radio-t.com","ts":"2024-01-01T12:00:00Z"}`,
+			result: `{"error":"dest doesn't match token"}` + "\n"},
+		{url: "/api/insert", token: "bad", code: http.StatusUnauthorized,
+			body:   `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`,
+			result: `{"error":"Unauthorized"}` + "\n"},
+		{url: "/api/insert/batch", code: http.StatusUnauthorized, body: "", result: `{"error":"Unauthorized"}` + "\n"},
+		{url: "/api/insert/batch", token: "secret6", code: http.StatusOK,
+			body: `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}` + "\n" +
+				`{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n7.radio-t.com","ts":"2024-01-01T12:00:00Z"}`,
+			result: `{"accepted":1,"rejected":1,"results":[{"line":1,"result":"ok"},` +
+				`{"line":2,"error":"dest doesn't match token"}]}` + "\n"},
+	}
+	for i, tt := range tbl {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+tt.url, strings.NewReader(tt.body))
+		require.NoError(t, err)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, tt.code, resp.StatusCode, i)
+		assert.Equal(t, tt.result, string(body), i)
+	}
+	assert.Equal(t, map[string]int{"forbidden_dest": 2, "unauthorized": 2}, srv.metrics.rejected)
+}
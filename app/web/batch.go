@@ -0,0 +1,131 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// maxBatchLineSize limits the size of a single NDJSON line in batch insert
+const maxBatchLineSize = 1024 * 1024
+
+// batchResult is a response for batch insert with accept/reject status of every record
+type batchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchLineResult `json:"results"`
+	Error    string            `json:"error,omitempty"` // set if reading stopped early, lines after the last result are not processed
+}
+
+// batchLineResult is a status of a single record in batch, Line is 1-based
+// line number for NDJSON input and 1-based element number for JSON array input
+type batchLineResult struct {
+	Line   int    `json:"line"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// add records result for the line, empty errMsg means record accepted
+func (b *batchResult) add(line int, errMsg string) {
+	if errMsg == "" {
+		b.Accepted++
+		b.Results = append(b.Results, batchLineResult{Line: line, Result: "ok"})
+		return
+	}
+	b.Rejected++
+	b.Results = append(b.Results, batchLineResult{Line: line, Error: errMsg})
+}
+
+// batchCutError is returned by decodeLogRecords when reading stopped at the line, lines after it are not read
+type batchCutError struct {
+	line int
+	err  error
+}
+
+func (e *batchCutError) Error() string {
+	return fmt.Sprintf("batch cut at line %d: %v", e.line, e.err)
+}
+
+func (e *batchCutError) Unwrap() error {
+	return e.err
+}
+
+// decodeLogRecords reads either JSON array or newline-delimited JSON stream of LogRecords
+// and calls fn for every record in order. Records which can't be decoded are passed to fn
+// with non-nil error. Decoding of JSON array stops on the first syntax error as the rest of
+// the stream can't be recovered, NDJSON decoding continues with the next line unless the line
+// can't be read, like a line longer than maxBatchLineSize. Either way the failed line is passed to fn,
+// and batchCutError is returned.
+func decodeLogRecords(r io.Reader, fn func(line int, l store.LogRecord, err error)) error {
+	br := bufio.NewReader(r)
+
+	// skip leading whitespace to detect input format by the first meaningful byte
+	for {
+		b, err := br.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return nil // empty batch
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			break
+		}
+		if _, err = br.Discard(1); err != nil {
+			return err
+		}
+	}
+
+	if b, _ := br.Peek(1); b[0] == '[' {
+		return decodeLogRecordsArray(br, fn)
+	}
+	return decodeLogRecordsNDJSON(br, fn)
+}
+
+func decodeLogRecordsArray(r io.Reader, fn func(line int, l store.LogRecord, err error)) error {
+	decoder := json.NewDecoder(r)
+	if _, err := decoder.Token(); err != nil { // opening bracket
+		return err
+	}
+	line := 1
+	for ; decoder.More(); line++ {
+		var l store.LogRecord
+		err := decoder.Decode(&l)
+		fn(line, l, err)
+		var typeErr *json.UnmarshalTypeError
+		if err != nil && !errors.As(err, &typeErr) {
+			return &batchCutError{line: line, err: err} // decoder can't recover after syntax error
+		}
+	}
+	if _, err := decoder.Token(); err != nil { // closing bracket
+		fn(line, store.LogRecord{}, err)
+		return &batchCutError{line: line, err: err}
+	}
+	return nil
+}
+
+func decodeLogRecordsNDJSON(r io.Reader, fn func(line int, l store.LogRecord, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var l store.LogRecord
+		err := json.Unmarshal(data, &l)
+		fn(line, l, err)
+	}
+	if err := scanner.Err(); err != nil {
+		fn(line+1, store.LogRecord{}, err)
+		return &batchCutError{line: line + 1, err: err}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestDecodeLogRecords(t *testing.T) {
+	type decoded struct {
+		line int
+		file string
+		err  bool
+	}
+
+	tbl := []struct {
+		name string
+		in   string
+		res  []decoded
+	}{
+		{name: "empty", in: "", res: nil},
+		{name: "whitespace only", in: " \n\t ", res: nil},
+		{name: "empty array", in: "[]", res: nil},
+		{name: "array", in: ` [{"file_name":"f1.mp3"}, {"file_name":"f2.mp3"}]`,
+			res: []decoded{{line: 1, file: "f1.mp3"}, {line: 2, file: "f2.mp3"}}},
+		{name: "array with type error", in: `[{"file_name":1}, {"file_name":"f2.mp3"}]`,
+			res: []decoded{{line: 1, err: true}, {line: 2, file: "f2.mp3"}}},
+		{name: "ndjson", in: "{\"file_name\":\"f1.mp3\"}\n\n{\"file_name\":\"f3.mp3\"}\n",
+			res: []decoded{{line: 1, file: "f1.mp3"}, {line: 3, file: "f3.mp3"}}},
+		{name: "ndjson with bad line", in: "{\"file_name\":\"f1.mp3\"}\n{bad\r\n{\"file_name\":\"f3.mp3\"}",
+			res: []decoded{{line: 1, file: "f1.mp3"}, {line: 2, err: true}, {line: 3, file: "f3.mp3"}}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			var res []decoded
+			err := decodeLogRecords(strings.NewReader(tt.in), func(line int, l store.LogRecord, err error) {
+				res = append(res, decoded{line: line, file: l.FileName, err: err != nil})
+				if err != nil {
+					res[len(res)-1].file = ""
+				}
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+
+	cutTbl := []struct {
+		name string
+		in   string
+		res  []decoded
+		line int
+	}{
+		{name: "array with syntax error", in: `[{"file_name":"f1.mp3"}, {"file_name":}, {"file_name":"f3.mp3"}]`,
+			res: []decoded{{line: 1, file: "f1.mp3"}, {line: 2, err: true}}, line: 2},
+		{name: "broken array start", in: "[}", res: []decoded{{line: 1, err: true}}, line: 1},
+		{name: "too long ndjson line", in: "{\"file_name\":\"f1.mp3\"}\n\n" + strings.Repeat("x", maxBatchLineSize+1) + "\n{}",
+			res: []decoded{{line: 1, file: "f1.mp3"}, {line: 3, err: true}}, line: 3},
+	}
+	for _, tt := range cutTbl {
+		t.Run(tt.name, func(t *testing.T) {
+			var res []decoded
+			err := decodeLogRecords(strings.NewReader(tt.in), func(line int, l store.LogRecord, err error) {
+				res = append(res, decoded{line: line, file: l.FileName, err: err != nil})
+			})
+			var cut *batchCutError
+			require.ErrorAs(t, err, &cut)
+			assert.Equal(t, tt.line, cut.line)
+			assert.Equal(t, tt.res, res, "failed line reported, the rest is not read")
+		})
+	}
+}
+
+func TestValidateLogRecord(t *testing.T) {
+	good := store.LogRecord{FromIP: "127.0.0.1", FileName: "f.mp3", DestHost: "n1", Date: time.Unix(60, 0)}
+	assert.NoError(t, validateLogRecord(good))
+
+	l := good
+	l.Date = time.Time{}
+	assert.EqualError(t, validateLogRecord(l), "missing field in JSON: ts")
+	l = good
+	l.DestHost = ""
+	assert.EqualError(t, validateLogRecord(l), "missing field in JSON: dest")
+	l = good
+	l.FileName = ""
+	assert.EqualError(t, validateLogRecord(l), "missing field in JSON: file_name")
+	l = good
+	l.FromIP = ""
+	assert.EqualError(t, validateLogRecord(l), "missing field in JSON: from_ip")
+}
@@ -0,0 +1,137 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+var calendarIntervalRe = regexp.MustCompile(`^(\d+)(d|w|mo)$`)
+
+// calendarInterval is aggregation interval of whole calendar days or months in some time zone.
+// Days are aligned to local midnight, weeks to Monday midnight and months to midnight of the first day.
+type calendarInterval struct {
+	days   int // length in days, 7 per week, zero for months
+	months int // length in months, zero for days and weeks
+	loc    *time.Location
+}
+
+// parseCalendarInterval parses calendar interval like 1d, 2w or 1mo, returns false for strings of other format
+func parseCalendarInterval(s string, loc *time.Location) (calendarInterval, bool, error) {
+	m := calendarIntervalRe.FindStringSubmatch(s)
+	if m == nil {
+		return calendarInterval{}, false, nil
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return calendarInterval{}, true, fmt.Errorf("invalid calendar interval %q", s)
+	}
+	switch m[2] {
+	case "d":
+		return calendarInterval{days: n, loc: loc}, true, nil
+	case "w":
+		return calendarInterval{days: 7 * n, loc: loc}, true, nil
+	default:
+		return calendarInterval{months: n, loc: loc}, true, nil
+	}
+}
+
+// String returns interval in the format parsed by parseCalendarInterval, weeks as days
+func (ci calendarInterval) String() string {
+	if ci.months > 0 {
+		return fmt.Sprintf("%dmo", ci.months)
+	}
+	return fmt.Sprintf("%dd", ci.days)
+}
+
+// align returns start of the calendar day, ISO week or month t falls into
+func (ci calendarInterval) align(t time.Time) time.Time {
+	t = t.In(ci.loc)
+	switch {
+	case ci.months > 0:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, ci.loc)
+	case ci.days%7 == 0:
+		weekday := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(t.Year(), t.Month(), t.Day()-weekday, 0, 0, 0, 0, ci.loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, ci.loc)
+	}
+}
+
+// index returns number of the interval t falls into, counting from the interval started at start.
+// Calendar dates are compared instead of durations, as local days are 23 or 25 hours long on DST change.
+func (ci calendarInterval) index(start, t time.Time) int {
+	s, l := start.In(ci.loc), t.In(ci.loc)
+	var diff, length int
+	if ci.months > 0 {
+		diff = (l.Year()-s.Year())*12 + int(l.Month()) - int(s.Month())
+		length = ci.months
+	} else {
+		civil := func(t time.Time) int64 {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / int64(24*time.Hour/time.Second)
+		}
+		diff = int(civil(l) - civil(s))
+		length = ci.days
+	}
+	n := diff / length
+	if diff < 0 && diff%length != 0 {
+		n--
+	}
+	return n
+}
+
+// start returns start of n-th interval counting from the interval started at start
+func (ci calendarInterval) start(start time.Time, n int) time.Time {
+	s := start.In(ci.loc)
+	return time.Date(s.Year(), s.Month()+time.Month(n*ci.months), s.Day()+n*ci.days, 0, 0, 0, 0, ci.loc)
+}
+
+// resolution returns the coarsest stored resolution which candles never cross local midnight:
+// daily rollups are aligned to UTC midnight and hourly ones to UTC hours. Every zone offset within the period
+// is checked, and periods with zone transitions, like DST changes, get hourly resolution at most.
+func (ci calendarInterval) resolution(from, to time.Time) time.Duration {
+	res := 24 * time.Hour
+	for t := from.In(ci.loc); ; {
+		_, offset := t.Zone()
+		switch {
+		case offset%3600 != 0:
+			return time.Minute
+		case offset != 0:
+			res = time.Hour
+		}
+		_, end := t.ZoneBounds()
+		if end.IsZero() || !end.Before(to) {
+			return res
+		}
+		res, t = time.Hour, end
+	}
+}
+
+// loadCalendarCandles loads candles for given period of time, filters and aggregates them by calendar interval
+func loadCalendarCandles(ctx context.Context, engine store.Engine, from time.Time, to time.Time,
+	interval calendarInterval, filter candleFilter) ([]store.Candle, error) {
+
+	agg := newCalendarAggregator(from, interval)
+	err := iterateCandles(ctx, engine, from, to, interval.resolution(from, to), filter, func(c store.Candle) error {
+		agg.add(c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agg.candles(), nil
+}
+
+// newCalendarAggregator makes aggregator by calendar interval. Intervals are aligned to the start of the calendar
+// day, week or month from falls into, StartMinute of each candle is in the interval's time zone.
+func newCalendarAggregator(from time.Time, interval calendarInterval) *bucketAggregator {
+	first := interval.align(from)
+	return newBucketAggregator(func(t time.Time) (int64, time.Time) {
+		n := interval.index(first, t)
+		return int64(n), interval.start(first, n)
+	})
+}
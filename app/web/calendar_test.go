@@ -0,0 +1,172 @@
+package web
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestParseCalendarInterval(t *testing.T) {
+	tbl := []struct {
+		in         string
+		calendar   bool
+		err        bool
+		days, mons int
+	}{
+		{in: "1d", calendar: true, days: 1},
+		{in: "3d", calendar: true, days: 3},
+		{in: "1w", calendar: true, days: 7},
+		{in: "2w", calendar: true, days: 14},
+		{in: "1mo", calendar: true, mons: 1},
+		{in: "12mo", calendar: true, mons: 12},
+		{in: "0d", calendar: true, err: true},
+		{in: "99999999999999999999d", calendar: true, err: true},
+		{in: "1h"},
+		{in: "1m"},
+		{in: "1y"},
+		{in: "d"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.in, func(t *testing.T) {
+			ci, ok, err := parseCalendarInterval(tt.in, time.UTC)
+			assert.Equal(t, tt.calendar, ok)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.days, ci.days)
+			assert.Equal(t, tt.mons, ci.months)
+		})
+	}
+}
+
+func TestCalendarIntervalAlign(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+
+	ts := time.Date(2024, 3, 13, 22, 30, 0, 0, time.UTC) // Thursday 01:30 in Moscow
+	assert.Equal(t, time.Date(2024, 3, 14, 0, 0, 0, 0, moscow), calendarInterval{days: 1, loc: moscow}.align(ts))
+	assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, moscow), calendarInterval{days: 7, loc: moscow}.align(ts))
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, moscow), calendarInterval{months: 1, loc: moscow}.align(ts))
+	assert.Equal(t, time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC), calendarInterval{days: 1, loc: time.UTC}.align(ts))
+
+	// Sunday belongs to the week started on Monday before it
+	sunday := time.Date(2024, 3, 17, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), calendarInterval{days: 7, loc: time.UTC}.align(sunday))
+}
+
+func TestCalendarIntervalResolution(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+
+	from, to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 24*time.Hour, calendarInterval{days: 1, loc: time.UTC}.resolution(from, to))
+	assert.Equal(t, time.Hour, calendarInterval{days: 1, loc: moscow}.resolution(from, to))
+	assert.Equal(t, time.Minute, calendarInterval{days: 1, loc: kolkata}.resolution(from, to))
+
+	// offsets at both ends match, but DST changes in between
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+	from, to = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Hour, calendarInterval{days: 1, loc: london}.resolution(from, to))
+	assert.Equal(t, 24*time.Hour, calendarInterval{days: 1, loc: london}.resolution(from, from.Add(30*24*time.Hour)))
+	assert.Equal(t, time.Hour, calendarInterval{days: 1, loc: london}.resolution(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)), "summer time")
+}
+
+func TestAggregateCalendar(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+
+	hourly := func(from, to time.Time) []store.Candle {
+		var res []store.Candle
+		for ts := from; ts.Before(to); ts = ts.Add(time.Hour) {
+			c := store.NewCandle()
+			c.Update(store.LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com", Date: ts})
+			res = append(res, c)
+		}
+		return res
+	}
+
+	t.Run("days over DST change", func(t *testing.T) {
+		// clocks moved forward on 2024-03-10 and back on 2024-11-03 in New York
+		for _, day := range []struct {
+			date  time.Time
+			hours int
+		}{
+			{date: time.Date(2024, 3, 10, 0, 0, 0, 0, newYork), hours: 23},
+			{date: time.Date(2024, 11, 3, 0, 0, 0, 0, newYork), hours: 25},
+		} {
+			from := day.date.AddDate(0, 0, -1)
+			candles := hourly(from, day.date.AddDate(0, 0, 2))
+			res := aggregate(newCalendarAggregator(from, calendarInterval{days: 1, loc: newYork}), candles)
+			require.Len(t, res, 3)
+			assert.Equal(t, 24, res[0].Nodes["all"].Volume)
+			assert.Equal(t, day.hours, res[1].Nodes["all"].Volume)
+			assert.Equal(t, 24, res[2].Nodes["all"].Volume)
+			for i, c := range res {
+				assert.Equal(t, from.AddDate(0, 0, i), c.StartMinute)
+				assert.Equal(t, 0, c.StartMinute.Hour(), "local midnight")
+			}
+		}
+	})
+
+	t.Run("weeks", func(t *testing.T) {
+		from := time.Date(2024, 3, 6, 15, 0, 0, 0, moscow) // Wednesday
+		candles := hourly(from, time.Date(2024, 3, 18, 0, 0, 0, 0, moscow))
+		res := aggregate(newCalendarAggregator(from, calendarInterval{days: 7, loc: moscow}), candles)
+		require.Len(t, res, 2)
+		assert.Equal(t, time.Date(2024, 3, 4, 0, 0, 0, 0, moscow), res[0].StartMinute)
+		assert.Equal(t, 9+4*24, res[0].Nodes["all"].Volume, "Wednesday 15:00 till Sunday end")
+		assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, moscow), res[1].StartMinute)
+		assert.Equal(t, 7*24, res[1].Nodes["all"].Volume)
+	})
+
+	t.Run("months", func(t *testing.T) {
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, moscow)
+		candles := hourly(from, time.Date(2024, 4, 1, 0, 0, 0, 0, moscow))
+		res := aggregate(newCalendarAggregator(from, calendarInterval{months: 1, loc: moscow}), candles)
+		require.Len(t, res, 3)
+		for i, days := range []int{31, 29, 31} {
+			assert.Equal(t, time.Date(2024, time.Month(i+1), 1, 0, 0, 0, 0, moscow), res[i].StartMinute)
+			assert.Equal(t, days*24, res[i].Nodes["all"].Volume)
+		}
+
+		res = aggregate(newCalendarAggregator(from.AddDate(0, 1, 10), calendarInterval{months: 2, loc: moscow}), candles)
+		require.Len(t, res, 2, "January goes to the interval before from")
+		assert.Equal(t, time.Date(2023, 12, 1, 0, 0, 0, 0, moscow), res[0].StartMinute)
+		assert.Equal(t, 31*24, res[0].Nodes["all"].Volume)
+		assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, moscow), res[1].StartMinute)
+		assert.Equal(t, (29+31)*24, res[1].Nodes["all"].Volume)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Equal(t, []store.Candle{}, aggregate(newCalendarAggregator(time.Now(), calendarInterval{days: 1, loc: time.UTC}), nil))
+	})
+}
+
+func TestLoadCalendarCandles(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	db := &goodDB{saved: []store.Candle{storedCandle}}
+	res, err := loadCalendarCandles(context.Background(), db, time.Unix(0, 0), time.Unix(0, 0).Add(time.Hour),
+		calendarInterval{days: 1, loc: moscow}, candleFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Hour}, db.resolutions)
+	require.Len(t, res, 1)
+	assert.Equal(t, time.Date(1970, 1, 1, 0, 0, 0, 0, moscow), res[0].StartMinute)
+
+	_, err = loadCalendarCandles(context.Background(), MockDB{}, time.Unix(0, 0), time.Unix(0, 0).Add(time.Hour),
+		calendarInterval{days: 1, loc: moscow}, candleFilter{})
+	assert.EqualError(t, err, "test error")
+}
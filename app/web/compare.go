@@ -0,0 +1,196 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// comparison contains downloads for a period compared with the same period offset back in time
+type comparison struct {
+	From    time.Time         `json:"from"`
+	To      time.Time         `json:"to"`
+	Offset  string            `json:"offset"`  // offset of the previous period, like 7d, 1mo or 90m
+	Buckets []bucketChange    `json:"buckets"` // downloads from all nodes by aggregation interval
+	Nodes   map[string]change `json:"nodes"`   // downloads by node, including "all"
+	Files   []fileChange      `json:"files"`   // top files of the current period
+}
+
+// change contains downloads in the current and the previous periods
+type change struct {
+	Current  int      `json:"current"`
+	Previous int      `json:"previous"`
+	Delta    int      `json:"delta"`
+	Percent  *float64 `json:"percent"` // delta relative to previous downloads, null if there were none
+}
+
+// bucketChange is a change for aggregation interval started at Start in the current period
+type bucketChange struct {
+	Start time.Time `json:"start"`
+	change
+}
+
+// fileChange is a change for a single file
+type fileChange struct {
+	Name string `json:"name"`
+	change
+}
+
+// compareOffset is offset of the previous period, a duration or, with calendar aggregation, whole calendar
+// days or months
+type compareOffset struct {
+	duration time.Duration
+	calendar *calendarInterval
+}
+
+// parseCompareOffset parses offset of the previous period for given aggregation. With calendar aggregation
+// the offset is whole days, weeks or months, so calendar intervals of both periods start at the same local time.
+// Offset has to be a multiple of aggregation interval, so intervals of the previous period are the ones of
+// the current period shifted by offset. Empty offset means 7 days, or one aggregation interval if 7 days is not
+// a multiple of it.
+func parseCompareOffset(s string, agg aggregation) (compareOffset, error) {
+	if s == "" {
+		if res, err := parseCompareOffset("7d", agg); err == nil {
+			return res, nil
+		}
+		if agg.calendar != nil {
+			return compareOffset{calendar: agg.calendar}, nil
+		}
+		return compareOffset{duration: durationInterval(agg.duration)}, nil
+	}
+	if agg.calendar != nil {
+		ci, ok, err := parseCalendarInterval(s, agg.calendar.loc)
+		switch {
+		case err != nil:
+			return compareOffset{}, err
+		case !ok:
+			return compareOffset{}, fmt.Errorf("offset %q should be whole days, weeks or months with calendar aggregation", s)
+		case agg.calendar.months > 0 && (ci.months == 0 || ci.months%agg.calendar.months != 0),
+			agg.calendar.days > 0 && (ci.days == 0 || ci.days%agg.calendar.days != 0):
+			return compareOffset{}, fmt.Errorf("offset %q is not a multiple of aggregation interval %v", s, agg.calendar)
+		}
+		return compareOffset{calendar: &ci}, nil
+	}
+	d, err := parseDays(s)
+	if err != nil {
+		return compareOffset{}, err
+	}
+	interval := durationInterval(agg.duration)
+	switch {
+	case d <= 0:
+		return compareOffset{}, errors.New("offset should be positive")
+	case d%interval != 0:
+		return compareOffset{}, fmt.Errorf("offset %q is not a multiple of aggregation interval %v", s, interval)
+	}
+	return compareOffset{duration: d}, nil
+}
+
+// back returns t moved back by offset. Calendar offsets keep local time of day in the aggregation's time zone,
+// even across DST changes.
+func (o compareOffset) back(t time.Time) time.Time {
+	if o.calendar == nil {
+		return t.Add(-o.duration)
+	}
+	return t.In(o.calendar.loc).AddDate(0, -o.calendar.months, -o.calendar.days)
+}
+
+// forward returns t moved forward by offset, reverting back
+func (o compareOffset) forward(t time.Time) time.Time {
+	if o.calendar == nil {
+		return t.Add(o.duration)
+	}
+	return t.In(o.calendar.loc).AddDate(0, o.calendar.months, o.calendar.days)
+}
+
+// String returns offset in the format it's parsed from, whole days of duration with d suffix
+func (o compareOffset) String() string {
+	switch {
+	case o.calendar != nil:
+		return o.calendar.String()
+	case o.duration%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", o.duration/(24*time.Hour))
+	default:
+		return o.duration.String()
+	}
+}
+
+// newChange calculates delta and percent between current and previous downloads
+func newChange(current, previous int) change {
+	res := change{Current: current, Previous: previous, Delta: current - previous}
+	if previous != 0 {
+		percent := 100 * float64(res.Delta) / float64(previous)
+		res.Percent = &percent
+	}
+	return res
+}
+
+// compareCandles compares aggregated candles of the current period with candles of the previous one.
+// Intervals are paired by start time shifted by offset, files are limited to filesLimit top files of the current period.
+func compareCandles(current, previous []store.Candle, offset compareOffset, filesLimit int) comparison {
+	type totals struct {
+		nodes map[string]int
+		files map[string]int
+	}
+	sum := func(candles []store.Candle) totals {
+		res := totals{nodes: map[string]int{}, files: map[string]int{}}
+		for _, c := range candles {
+			for name, node := range c.Nodes {
+				res.nodes[name] += node.Volume
+				if name != "all" {
+					continue
+				}
+				for file, count := range node.Files {
+					res.files[file] += count
+				}
+			}
+		}
+		return res
+	}
+	cur, prev := sum(current), sum(previous)
+
+	res := comparison{Offset: offset.String(), Buckets: []bucketChange{}, Nodes: map[string]change{},
+		Files: []fileChange{}}
+	for name, volume := range cur.nodes {
+		res.Nodes[name] = newChange(volume, prev.nodes[name])
+	}
+	for name, volume := range prev.nodes {
+		if _, ok := cur.nodes[name]; !ok {
+			res.Nodes[name] = newChange(0, volume)
+		}
+	}
+	for _, f := range store.TopCounts(cur.files, filesLimit) {
+		res.Files = append(res.Files, fileChange{Name: f.Key, change: newChange(f.Count, prev.files[f.Key])})
+	}
+
+	type pair struct {
+		start             time.Time
+		current, previous int
+	}
+	pairs := map[int64]*pair{}
+	add := func(start time.Time, volume int, isCurrent bool) {
+		p, ok := pairs[start.Unix()]
+		if !ok {
+			p = &pair{start: start}
+			pairs[start.Unix()] = p
+		}
+		if isCurrent {
+			p.current += volume
+			return
+		}
+		p.previous += volume
+	}
+	for _, c := range current {
+		add(c.StartMinute, c.Nodes["all"].Volume, true)
+	}
+	for _, c := range previous {
+		add(offset.forward(c.StartMinute), c.Nodes["all"].Volume, false)
+	}
+	for _, p := range pairs {
+		res.Buckets = append(res.Buckets, bucketChange{Start: p.start, change: newChange(p.current, p.previous)})
+	}
+	sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].Start.Before(res.Buckets[j].Start) })
+	return res
+}
@@ -0,0 +1,132 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestCompareCandles(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	day := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	candle := func(start time.Time, n6, n7 int, files map[string]int) store.Candle {
+		c := store.Candle{Nodes: map[string]store.Info{"all": {Volume: n6 + n7, Files: files}}, StartMinute: start}
+		if n6 > 0 {
+			c.Nodes["n6.radio-t.com"] = store.Info{Volume: n6, Files: map[string]int{}}
+		}
+		if n7 > 0 {
+			c.Nodes["n7.radio-t.com"] = store.Info{Volume: n7, Files: map[string]int{}}
+		}
+		return c
+	}
+	current := []store.Candle{
+		candle(day, 3, 1, map[string]int{"/rtfiles/rt_podcast562.mp3": 3, "/rtfiles/rt_podcast561.mp3": 1}),
+		candle(day.Add(48*time.Hour), 2, 0, map[string]int{"/rtfiles/rt_podcast562.mp3": 2}),
+	}
+	previous := []store.Candle{
+		candle(day.Add(-week), 2, 0, map[string]int{"/rtfiles/rt_podcast561.mp3": 2}),
+		candle(day.Add(-week+24*time.Hour), 0, 1, map[string]int{"/rtfiles/rt_podcast560.mp3": 1}),
+	}
+
+	res := compareCandles(current, previous, compareOffset{duration: week}, 2)
+	data, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"from":"0001-01-01T00:00:00Z","to":"0001-01-01T00:00:00Z","offset":"7d",
+		"buckets":[
+			{"start":"2024-01-08T00:00:00Z","current":4,"previous":2,"delta":2,"percent":100},
+			{"start":"2024-01-09T00:00:00Z","current":0,"previous":1,"delta":-1,"percent":-100},
+			{"start":"2024-01-10T00:00:00Z","current":2,"previous":0,"delta":2,"percent":null}
+		],
+		"nodes":{
+			"all":{"current":6,"previous":3,"delta":3,"percent":100},
+			"n6.radio-t.com":{"current":5,"previous":2,"delta":3,"percent":150},
+			"n7.radio-t.com":{"current":1,"previous":1,"delta":0,"percent":0}
+		},
+		"files":[
+			{"name":"/rtfiles/rt_podcast562.mp3","current":5,"previous":0,"delta":5,"percent":null},
+			{"name":"/rtfiles/rt_podcast561.mp3","current":1,"previous":2,"delta":-1,"percent":-50}
+		]}`, string(data))
+
+	res = compareCandles(nil, previous, compareOffset{duration: week}, 10)
+	assert.Equal(t, change{Current: 0, Previous: 3, Delta: -3, Percent: res.Nodes["all"].Percent}, res.Nodes["all"])
+	assert.InDelta(t, -100, *res.Nodes["all"].Percent, 0.001)
+	assert.Empty(t, res.Files)
+	assert.Len(t, res.Buckets, 2)
+}
+
+func TestCompareCandles_Calendar(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	candle := func(start time.Time) store.Candle {
+		return store.Candle{Nodes: map[string]store.Info{"all": {Volume: 1}}, StartMinute: start}
+	}
+
+	// daily intervals of the week after DST change and of the week before it
+	daily := calendarInterval{days: 1, loc: berlin}
+	var current, previous []store.Candle
+	for i := range 7 {
+		current = append(current, candle(time.Date(2024, 4, 1+i, 0, 0, 0, 0, berlin)))
+		previous = append(previous, candle(time.Date(2024, 3, 25+i, 0, 0, 0, 0, berlin)))
+	}
+	offset, err := parseCompareOffset("7d", aggregation{calendar: &daily})
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 25, 0, 0, 0, 0, berlin), offset.back(time.Date(2024, 4, 1, 0, 0, 0, 0, berlin)))
+	res := compareCandles(current, previous, offset, 10)
+	require.Len(t, res.Buckets, 7)
+	for i, b := range res.Buckets {
+		assert.True(t, time.Date(2024, 4, 1+i, 0, 0, 0, 0, berlin).Equal(b.Start))
+		assert.Equal(t, newChange(1, 1), b.change)
+	}
+
+	// monthly intervals are shifted by calendar months
+	monthly := calendarInterval{months: 1, loc: berlin}
+	offset, err = parseCompareOffset("1mo", aggregation{calendar: &monthly})
+	require.NoError(t, err)
+	res = compareCandles([]store.Candle{candle(time.Date(2024, 3, 1, 0, 0, 0, 0, berlin))},
+		[]store.Candle{candle(time.Date(2024, 2, 1, 0, 0, 0, 0, berlin))}, offset, 10)
+	require.Len(t, res.Buckets, 1)
+	assert.Equal(t, newChange(1, 1), res.Buckets[0].change)
+	assert.Equal(t, "1mo", res.Offset)
+}
+
+func TestParseCompareOffset(t *testing.T) {
+	daily, weekly, monthly := calendarInterval{days: 1, loc: time.UTC}, calendarInterval{days: 14, loc: time.UTC},
+		calendarInterval{months: 1, loc: time.UTC}
+	tbl := []struct {
+		offset string
+		agg    aggregation
+		res    string
+		err    bool
+	}{
+		{offset: "", agg: aggregation{duration: time.Hour}, res: "7d"},
+		{offset: "", agg: aggregation{duration: 5 * time.Hour}, res: "5h0m0s"},
+		{offset: "", agg: aggregation{calendar: &daily}, res: "7d"},
+		{offset: "", agg: aggregation{calendar: &weekly}, res: "14d"},
+		{offset: "", agg: aggregation{calendar: &monthly}, res: "1mo"},
+		{offset: "90m", agg: aggregation{duration: 30 * time.Minute}, res: "1h30m0s"},
+		{offset: "90m", agg: aggregation{duration: time.Hour}, err: true},
+		{offset: "-1d", agg: aggregation{duration: time.Hour}, err: true},
+		{offset: "bad", agg: aggregation{duration: time.Hour}, err: true},
+		{offset: "4w", agg: aggregation{calendar: &weekly}, res: "28d"},
+		{offset: "3d", agg: aggregation{calendar: &weekly}, err: true},
+		{offset: "30d", agg: aggregation{calendar: &monthly}, err: true},
+		{offset: "12mo", agg: aggregation{calendar: &monthly}, res: "12mo"},
+		{offset: "36h", agg: aggregation{calendar: &daily}, err: true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.offset, func(t *testing.T) {
+			res, err := parseCompareOffset(tt.offset, tt.agg)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res.String())
+		})
+	}
+}
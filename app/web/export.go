@@ -0,0 +1,198 @@
+package web
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// exportRow is a single flattened row of exported candle. Empty file means total volume of the node.
+type exportRow struct {
+	Minute time.Time `json:"minute"`
+	Node   string    `json:"node"`
+	File   string    `json:"file"`
+	Count  int       `json:"count"`
+}
+
+// rowWriter writes exported rows in some format
+type rowWriter interface {
+	Write(row exportRow) error
+	Close() error // writes buffered data, and header if there were no rows
+}
+
+// exportFormat returns export format requested by 'format' query parameter or Accept header,
+// empty string for default JSON
+func exportFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "csv", "ndjson":
+		return format, nil
+	case "json":
+		return "", nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv", nil
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson", nil
+	}
+	return "", nil
+}
+
+// exportResolution returns resolution of exported candles from optional 'aggregate' query parameter,
+// which has to be one of the stored resolutions, as exported candles are not aggregated
+func exportResolution(r *http.Request) (time.Duration, error) {
+	a := r.URL.Query().Get("aggregate")
+	if a == "" {
+		return time.Minute, nil
+	}
+	d, err := time.ParseDuration(a)
+	if err != nil {
+		return 0, err
+	}
+	if d != time.Minute && !slices.Contains(rollupResolutions, d) {
+		return 0, fmt.Errorf("export supports only 1m, 1h and 24h aggregation, got %v", d)
+	}
+	return d, nil
+}
+
+// newRowWriter makes writer for given format and sets response content type
+func newRowWriter(w http.ResponseWriter, format string) rowWriter {
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		return &csvRowWriter{w: csv.NewWriter(w)}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return &ndjsonRowWriter{enc: json.NewEncoder(w)}
+}
+
+// csvRowWriter writes rows as CSV with header
+type csvRowWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvRowWriter) writeHeader() error {
+	if c.header {
+		return nil
+	}
+	c.header = true
+	return c.w.Write([]string{"minute", "node", "file", "count"})
+}
+
+// Write writes header before the first row
+func (c *csvRowWriter) Write(row exportRow) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.w.Write([]string{row.Minute.Format(time.RFC3339), row.Node, row.File, strconv.Itoa(row.Count)})
+}
+
+// Close writes header if there were no rows and flushes buffered rows
+func (c *csvRowWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonRowWriter writes rows as newline-delimited JSON
+type ndjsonRowWriter struct {
+	enc *json.Encoder
+}
+
+// Write encodes row as a JSON line
+func (n *ndjsonRowWriter) Write(row exportRow) error {
+	return n.enc.Encode(row)
+}
+
+// Close does nothing, as rows are not buffered
+func (n *ndjsonRowWriter) Close() error {
+	return nil
+}
+
+// writeCandleRows flattens candle to rows ordered by node and file: a row with node volume and empty file,
+// followed by rows of the node's files
+func writeCandleRows(rw rowWriter, c store.Candle) error {
+	nodes := make([]string, 0, len(c.Nodes))
+	for name := range c.Nodes {
+		nodes = append(nodes, name)
+	}
+	sort.Strings(nodes)
+	for _, name := range nodes {
+		node := c.Nodes[name]
+		if err := rw.Write(exportRow{Minute: c.StartMinute, Node: name, Count: node.Volume}); err != nil {
+			return err
+		}
+		files := make([]string, 0, len(node.Files))
+		for f := range node.Files {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			if err := rw.Write(exportRow{Minute: c.StartMinute, Node: name, File: f, Count: node.Files[f]}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportChunk limits number of candles read from engine at once by export, so rows are written to a slow client
+// without keeping storage transaction open
+const exportChunk = 1000
+
+// errChunkFull stops reading of candles once the chunk is full
+var errChunkFull = errors.New("export chunk is full")
+
+// exportCandles writes filtered candles of given resolution as rows. Candles are read from engine in chunks
+// of exportChunk, and rows of each chunk are written after it's read, so error after the first row can't change
+// response status, and is only returned.
+func exportCandles(ctx context.Context, w http.ResponseWriter, engine store.Engine, format string, from, to time.Time,
+	resolution time.Duration, filter candleFilter) (started bool, err error) {
+	var rw rowWriter
+	for {
+		chunk := make([]store.Candle, 0, exportChunk)
+		err = iterateCandles(ctx, engine, from, to, resolution, filter, func(c store.Candle) error {
+			chunk = append(chunk, c)
+			if len(chunk) == exportChunk {
+				return errChunkFull
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errChunkFull) {
+			return started, err
+		}
+		for _, c := range chunk {
+			if rw == nil {
+				rw, started = newRowWriter(w, format), true
+			}
+			if werr := writeCandleRows(rw, c); werr != nil {
+				return started, werr
+			}
+		}
+		if err == nil {
+			break
+		}
+		// candles are ordered by time and stored by unix seconds, so the next chunk starts right after the last candle
+		from = chunk[len(chunk)-1].StartMinute.Add(time.Second)
+	}
+	if rw == nil {
+		rw, started = newRowWriter(w, format), true
+	}
+	return started, rw.Close()
+}
@@ -0,0 +1,179 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestExportFormat(t *testing.T) {
+	tbl := []struct {
+		url, accept string
+		format      string
+		err         bool
+	}{
+		{url: "/api/candle", format: ""},
+		{url: "/api/candle?format=csv", format: "csv"},
+		{url: "/api/candle?format=ndjson", format: "ndjson"},
+		{url: "/api/candle?format=json", accept: "text/csv", format: ""},
+		{url: "/api/candle?format=xml", err: true},
+		{url: "/api/candle", accept: "text/csv", format: "csv"},
+		{url: "/api/candle", accept: "application/x-ndjson", format: "ndjson"},
+		{url: "/api/candle", accept: "application/json", format: ""},
+		{url: "/api/candle?format=ndjson", accept: "text/csv", format: "ndjson"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.url+" "+tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, http.NoBody)
+			r.Header.Set("Accept", tt.accept)
+			format, err := exportFormat(r)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.format, format)
+		})
+	}
+}
+
+func TestExportResolution(t *testing.T) {
+	tbl := []struct {
+		aggregate  string
+		resolution time.Duration
+		err        bool
+	}{
+		{aggregate: "", resolution: time.Minute},
+		{aggregate: "1m", resolution: time.Minute},
+		{aggregate: "1h", resolution: time.Hour},
+		{aggregate: "24h", resolution: 24 * time.Hour},
+		{aggregate: "5m", err: true},
+		{aggregate: "bad", err: true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.aggregate, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/candle?aggregate="+tt.aggregate, http.NoBody)
+			resolution, err := exportResolution(r)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.resolution, resolution)
+		})
+	}
+}
+
+func TestExportCandles(t *testing.T) {
+	db := &goodDB{saved: []store.Candle{
+		{Nodes: map[string]store.Info{
+			"n7.radio-t.com": {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast562.mp3": 1}},
+			"n6.radio-t.com": {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1, "/rtfiles/rt_podcast560.mp3": 1}},
+			"all": {Volume: 3, Files: map[string]int{"/rtfiles/rt_podcast560.mp3": 1, "/rtfiles/rt_podcast561.mp3": 1,
+				"/rtfiles/rt_podcast562.mp3": 1}},
+		}, StartMinute: time.Unix(0, 0).UTC()},
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+			"all":            {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+		}, StartMinute: time.Unix(60, 0).UTC()},
+	}}
+	ctx := context.Background()
+
+	t.Run("csv", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		started, err := exportCandles(ctx, w, db, "csv", time.Unix(0, 0), time.Unix(60, 0), time.Minute, candleFilter{})
+		require.NoError(t, err)
+		assert.True(t, started)
+		assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "minute,node,file,count\n"+
+			"1970-01-01T00:00:00Z,all,,3\n"+
+			"1970-01-01T00:00:00Z,all,/rtfiles/rt_podcast560.mp3,1\n"+
+			"1970-01-01T00:00:00Z,all,/rtfiles/rt_podcast561.mp3,1\n"+
+			"1970-01-01T00:00:00Z,all,/rtfiles/rt_podcast562.mp3,1\n"+
+			"1970-01-01T00:00:00Z,n6.radio-t.com,,2\n"+
+			"1970-01-01T00:00:00Z,n6.radio-t.com,/rtfiles/rt_podcast560.mp3,1\n"+
+			"1970-01-01T00:00:00Z,n6.radio-t.com,/rtfiles/rt_podcast561.mp3,1\n"+
+			"1970-01-01T00:00:00Z,n7.radio-t.com,,1\n"+
+			"1970-01-01T00:00:00Z,n7.radio-t.com,/rtfiles/rt_podcast562.mp3,1\n"+
+			"1970-01-01T00:01:00Z,all,,1\n"+
+			"1970-01-01T00:01:00Z,all,/rtfiles/rt_podcast561.mp3,1\n"+
+			"1970-01-01T00:01:00Z,n6.radio-t.com,,1\n"+
+			"1970-01-01T00:01:00Z,n6.radio-t.com,/rtfiles/rt_podcast561.mp3,1\n", w.Body.String())
+	})
+
+	t.Run("ndjson with filter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		filter := candleFilter{nodes: map[string]bool{"n7.radio-t.com": true}}
+		started, err := exportCandles(ctx, w, db, "ndjson", time.Unix(0, 0), time.Unix(60, 0), time.Minute, filter)
+		require.NoError(t, err)
+		assert.True(t, started)
+		assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+		assert.Equal(t, `{"minute":"1970-01-01T00:00:00Z","node":"n7.radio-t.com","file":"","count":1}`+"\n"+
+			`{"minute":"1970-01-01T00:00:00Z","node":"n7.radio-t.com","file":"/rtfiles/rt_podcast562.mp3","count":1}`+"\n",
+			w.Body.String())
+	})
+
+	t.Run("csv without candles has header only", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		started, err := exportCandles(ctx, w, &goodDB{}, "csv", time.Unix(0, 0), time.Unix(60, 0), time.Minute, candleFilter{})
+		require.NoError(t, err)
+		assert.True(t, started)
+		assert.Equal(t, "minute,node,file,count\n", w.Body.String())
+	})
+
+	t.Run("read in chunks", func(t *testing.T) {
+		db := &periodDB{}
+		for i := range 2*exportChunk + 1 {
+			db.saved = append(db.saved, store.Candle{Nodes: map[string]store.Info{"all": {Volume: i + 1}},
+				StartMinute: time.Unix(int64(i*60), 0).UTC()})
+		}
+		w := httptest.NewRecorder()
+		started, err := exportCandles(ctx, w, db, "ndjson", time.Unix(0, 0), time.Unix(int64(3*exportChunk*60), 0),
+			time.Minute, candleFilter{})
+		require.NoError(t, err)
+		assert.True(t, started)
+		assert.Equal(t, 3, db.calls)
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		require.Len(t, lines, 2*exportChunk+1, "every candle exported once")
+		assert.Equal(t, `{"minute":"1970-01-01T00:00:00Z","node":"all","file":"","count":1}`, lines[0])
+		assert.Equal(t, fmt.Sprintf(`{"minute":%q,"node":"all","file":"","count":%d}`,
+			time.Unix(int64(exportChunk*60), 0).UTC().Format(time.RFC3339), exportChunk+1), lines[exportChunk])
+	})
+
+	t.Run("engine error before streaming", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		started, err := exportCandles(ctx, w, MockDB{}, "csv", time.Unix(0, 0), time.Unix(60, 0), time.Minute, candleFilter{})
+		assert.EqualError(t, err, "test error")
+		assert.False(t, started)
+		assert.Empty(t, w.Body.String())
+	})
+}
+
+// periodDB is goodDB which iterates over candles started within the period only, and counts iterations
+type periodDB struct {
+	goodDB
+	calls int
+}
+
+func (p *periodDB) Iterate(ctx context.Context, periodStart, periodEnd time.Time, resolution time.Duration,
+	fn func(store.Candle) error) error {
+	p.calls++
+	for _, c := range p.saved {
+		if c.StartMinute.Before(periodStart) || c.StartMinute.After(periodEnd) {
+			continue
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// regexPrefix marks file pattern as regular expression
+const regexPrefix = "re:"
+
+// candleFilter selects nodes, files or countries of candles, empty filter keeps everything
+type candleFilter struct {
+	nodes     map[string]bool // nodes to keep, all nodes if empty
+	include   []fileMatcher   // files to keep, all files if empty
+	exclude   []fileMatcher   // files to drop
+	countries map[string]bool // countries to keep, all countries if empty
+}
+
+// fileMatcher reports whether file name matches a pattern
+type fileMatcher func(name string) bool
+
+// parseFileMatchers makes matchers from patterns: "re:" prefix marks regular expression, pattern with any of "*?["
+// is a glob in path.Match syntax, and anything else matches the file name exactly
+func parseFileMatchers(patterns []string) ([]fileMatcher, error) {
+	var res []fileMatcher
+	for _, p := range patterns {
+		switch {
+		case strings.HasPrefix(p, regexPrefix):
+			re, err := regexp.Compile(strings.TrimPrefix(p, regexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("bad regexp %q: %w", p, err)
+			}
+			res = append(res, re.MatchString)
+		case strings.ContainsAny(p, "*?["):
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("bad glob %q: %w", p, err)
+			}
+			res = append(res, func(name string) bool {
+				ok, _ := path.Match(p, name)
+				return ok
+			})
+		default:
+			res = append(res, func(name string) bool { return name == p })
+		}
+	}
+	return res, nil
+}
+
+// parseCandleFilter parses optional 'node', 'file', 'exclude_file' and 'country' query parameters, each can be
+// repeated. Sends error response and returns false if parameters are invalid. Downloads are not counted by file
+// and country together, so 'country' can't be combined with file filters.
+func parseCandleFilter(w http.ResponseWriter, r *http.Request) (candleFilter, bool) {
+	var err error
+	filter := candleFilter{}
+	if nodes := r.URL.Query()["node"]; len(nodes) != 0 {
+		filter.nodes = map[string]bool{}
+		for _, n := range nodes {
+			filter.nodes[n] = true
+		}
+	}
+	if filter.include, err = parseFileMatchers(r.URL.Query()["file"]); err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'file' field")
+		return candleFilter{}, false
+	}
+	if filter.exclude, err = parseFileMatchers(r.URL.Query()["exclude_file"]); err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'exclude_file' field")
+		return candleFilter{}, false
+	}
+	if countries := r.URL.Query()["country"]; len(countries) != 0 {
+		if len(filter.include) != 0 || len(filter.exclude) != 0 {
+			err = errors.New("country filter can't be combined with file filters")
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'country' field")
+			return candleFilter{}, false
+		}
+		filter.countries = map[string]bool{}
+		for _, c := range countries {
+			filter.countries[strings.ToUpper(c)] = true
+		}
+	}
+	return filter, true
+}
+
+// empty reports whether filter keeps candles intact
+func (f candleFilter) empty() bool {
+	return len(f.nodes) == 0 && len(f.include) == 0 && len(f.exclude) == 0 && len(f.countries) == 0
+}
+
+// keepFile reports whether file passes include and exclude matchers
+func (f candleFilter) keepFile(name string) bool {
+	for _, m := range f.exclude {
+		if m(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, m := range f.include {
+		if m(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns copy of candles with only selected nodes and files, see applyCandle.
+// Candles left without nodes and requests are dropped.
+func (f candleFilter) apply(candles []store.Candle) []store.Candle {
+	if f.empty() {
+		return candles
+	}
+	res := []store.Candle{}
+	for _, c := range candles {
+		if candle, ok := f.applyCandle(c); ok {
+			res = append(res, candle)
+		}
+	}
+	return res
+}
+
+// applyCandle returns copy of candle with only selected nodes and files, and false if neither nodes
+// nor requests left. With file filters node volume is the sum of kept files, so nodes without per-node files
+// (see store.Aggregator.NodeFiles) and nodes with no files kept are dropped, as well as raw requests.
+func (f candleFilter) applyCandle(c store.Candle) (store.Candle, bool) {
+	if f.empty() {
+		return c, true
+	}
+	if len(f.countries) != 0 {
+		return f.applyCountries(c)
+	}
+	filterFiles := len(f.include) != 0 || len(f.exclude) != 0
+	candle := store.Candle{Nodes: map[string]store.Info{}, StartMinute: c.StartMinute}
+	for name, node := range c.Nodes {
+		if len(f.nodes) != 0 && !f.nodes[name] {
+			continue
+		}
+		if !filterFiles {
+			candle.Nodes[name] = node
+			continue
+		}
+		info := store.NewInfo()
+		for file, count := range node.Files {
+			if f.keepFile(file) {
+				info.Files[file] = count
+				info.Volume += count
+			}
+		}
+		if info.Volume > 0 {
+			candle.Nodes[name] = info
+		}
+	}
+	if !filterFiles { // raw requests are not counted by file
+		for name, count := range c.Requests {
+			if len(f.nodes) != 0 && !f.nodes[name] {
+				continue
+			}
+			if candle.Requests == nil {
+				candle.Requests = map[string]int{}
+			}
+			candle.Requests[name] = count
+		}
+	}
+	if !filterFiles && (len(f.nodes) == 0 || f.nodes["all"]) { // locations and networks are counted from all nodes
+		candle.Countries, candle.Regions, candle.ASNs = c.Countries, c.Regions, c.ASNs
+	}
+	if c.Listeners != nil {
+		candle.Listeners = f.applyListeners(c.Listeners)
+	}
+	return candle, len(candle.Nodes) != 0 || len(candle.Requests) != 0
+}
+
+// applyCountries returns copy of candle with downloads of selected countries and their regions only, and false
+// if there are none. Nodes and files are not counted by country, so the result has only "all" node with volume
+// of selected countries, without files, and nothing is left if node filter doesn't select "all" node.
+func (f candleFilter) applyCountries(c store.Candle) (store.Candle, bool) {
+	candle := store.Candle{Nodes: map[string]store.Info{}, StartMinute: c.StartMinute}
+	if len(f.nodes) != 0 && !f.nodes["all"] {
+		return candle, false
+	}
+	volume := 0
+	for country, count := range c.Countries {
+		if f.countries[country] {
+			candle.Countries = keepCount(candle.Countries, country, count)
+			volume += count
+		}
+	}
+	for region, count := range c.Regions {
+		if country, _, _ := strings.Cut(region, "-"); f.countries[country] {
+			candle.Regions = keepCount(candle.Regions, region, count)
+		}
+	}
+	if volume == 0 {
+		return candle, false
+	}
+	candle.Nodes["all"] = store.Info{Volume: volume, Files: map[string]int{}}
+	return candle, true
+}
+
+// keepCount sets count of the key in m, making m if it's nil
+func keepCount(m map[string]int, key string, count int) map[string]int {
+	if m == nil {
+		m = map[string]int{}
+	}
+	m[key] = count
+	return m
+}
+
+// applyListeners returns listeners sketches of selected nodes and files. Node sketches can't be narrowed down
+// to files, so they are dropped with file filters, and file sketches are kept only with "all" node,
+// the same as file counts.
+func (f candleFilter) applyListeners(l *store.Listeners) *store.Listeners {
+	res := store.NewListeners()
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		for name, sketch := range l.Nodes {
+			if len(f.nodes) == 0 || f.nodes[name] {
+				res.Nodes[name] = sketch
+			}
+		}
+	}
+	if len(f.nodes) == 0 || f.nodes["all"] {
+		for file, sketch := range l.Files {
+			if f.keepFile(file) {
+				res.Files[file] = sketch
+			}
+		}
+	}
+	return res
+}
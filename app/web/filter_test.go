@@ -0,0 +1,207 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestParseFileMatchers(t *testing.T) {
+	tbl := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+		err     bool
+	}{
+		{pattern: "/rtfiles/rt_podcast561.mp3", match: []string{"/rtfiles/rt_podcast561.mp3"},
+			noMatch: []string{"/rtfiles/rt_podcast561.mp3.ogg", "rtfiles/rt_podcast561.mp3"}},
+		{pattern: "/rtfiles/rt_podcast56?.mp3", match: []string{"/rtfiles/rt_podcast561.mp3", "/rtfiles/rt_podcast569.mp3"},
+			noMatch: []string{"/rtfiles/rt_podcast570.mp3", "/rtfiles/rt_podcast5610.mp3"}},
+		{pattern: "/rtfiles/*.ogg", match: []string{"/rtfiles/rt_podcast561.ogg"},
+			noMatch: []string{"/rtfiles/rt_podcast561.mp3", "/rtfiles/old/rt_podcast561.ogg"}},
+		{pattern: "/rtfiles/rt_podcast5[6-7]0.mp3", match: []string{"/rtfiles/rt_podcast560.mp3", "/rtfiles/rt_podcast570.mp3"},
+			noMatch: []string{"/rtfiles/rt_podcast580.mp3"}},
+		{pattern: `re:rt_podcast8\d\d`, match: []string{"/rtfiles/rt_podcast800.mp3", "rt_podcast899.ogg"},
+			noMatch: []string{"/rtfiles/rt_podcast561.mp3"}},
+		{pattern: "re:(", err: true},
+		{pattern: "/rtfiles/[", err: true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.pattern, func(t *testing.T) {
+			matchers, err := parseFileMatchers([]string{tt.pattern})
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, matchers, 1)
+			for _, name := range tt.match {
+				assert.True(t, matchers[0](name), name)
+			}
+			for _, name := range tt.noMatch {
+				assert.False(t, matchers[0](name), name)
+			}
+		})
+	}
+
+	matchers, err := parseFileMatchers(nil)
+	require.NoError(t, err)
+	assert.Empty(t, matchers)
+}
+
+func TestCandleFilter(t *testing.T) {
+	candles := []store.Candle{
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 3, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast561.ogg": 1}},
+			"all":            {Volume: 3, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast561.ogg": 1}},
+		}, StartMinute: time.Unix(0, 0)},
+		{Nodes: map[string]store.Info{
+			"n7.radio-t.com": {Volume: 1, Files: map[string]int{}}, // no per-node files
+			"all":            {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast562.mp3": 1}},
+		}, StartMinute: time.Unix(60, 0)},
+	}
+	matchers := func(patterns ...string) []fileMatcher {
+		m, err := parseFileMatchers(patterns)
+		require.NoError(t, err)
+		return m
+	}
+
+	tbl := []struct {
+		name   string
+		filter candleFilter
+		out    []store.Candle
+	}{
+		{name: "empty", filter: candleFilter{}, out: candles},
+		{name: "node", filter: candleFilter{nodes: map[string]bool{"n7.radio-t.com": true}}, out: []store.Candle{
+			{Nodes: map[string]store.Info{"n7.radio-t.com": {Volume: 1, Files: map[string]int{}}}, StartMinute: time.Unix(60, 0)},
+		}},
+		{name: "two nodes", filter: candleFilter{nodes: map[string]bool{"n6.radio-t.com": true, "n7.radio-t.com": true}},
+			out: []store.Candle{
+				{Nodes: map[string]store.Info{"n6.radio-t.com": candles[0].Nodes["n6.radio-t.com"]}, StartMinute: time.Unix(0, 0)},
+				{Nodes: map[string]store.Info{"n7.radio-t.com": candles[1].Nodes["n7.radio-t.com"]}, StartMinute: time.Unix(60, 0)},
+			}},
+		{name: "unknown node", filter: candleFilter{nodes: map[string]bool{"n8.radio-t.com": true}}, out: []store.Candle{}},
+		{name: "file", filter: candleFilter{include: matchers("/rtfiles/*.mp3")}, out: []store.Candle{
+			{Nodes: map[string]store.Info{
+				"n6.radio-t.com": {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2}},
+				"all":            {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2}},
+			}, StartMinute: time.Unix(0, 0)},
+			{Nodes: map[string]store.Info{
+				"all": {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast562.mp3": 1}},
+			}, StartMinute: time.Unix(60, 0)},
+		}},
+		{name: "node and excluded file", filter: candleFilter{nodes: map[string]bool{"all": true},
+			exclude: matchers("re:\\.ogg$", "/rtfiles/rt_podcast562.mp3")}, out: []store.Candle{
+			{Nodes: map[string]store.Info{
+				"all": {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2}},
+			}, StartMinute: time.Unix(0, 0)},
+		}},
+		{name: "exclude wins over include", filter: candleFilter{include: matchers("/rtfiles/rt_podcast561.mp3"),
+			exclude: matchers("/rtfiles/rt_podcast561.mp3")}, out: []store.Candle{}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.out, tt.filter.apply(candles))
+		})
+	}
+	assert.Len(t, candles[0].Nodes, 2, "input not modified")
+	assert.Len(t, candles[0].Nodes["all"].Files, 2, "input not modified")
+}
+
+func TestCandleFilter_Listeners(t *testing.T) {
+	sketch := func(ips ...string) *store.HLL {
+		h := &store.HLL{}
+		for _, ip := range ips {
+			h.Add(ip)
+		}
+		return h
+	}
+	listeners := &store.Listeners{
+		Nodes: map[string]*store.HLL{"n6.radio-t.com": sketch("127.0.0.1"), "n7.radio-t.com": sketch("127.0.0.2"),
+			"all": sketch("127.0.0.1", "127.0.0.2")},
+		Files: map[string]*store.HLL{"a.mp3": sketch("127.0.0.1"), "b.ogg": sketch("127.0.0.2")},
+	}
+	matchers := func(patterns ...string) []fileMatcher {
+		m, err := parseFileMatchers(patterns)
+		require.NoError(t, err)
+		return m
+	}
+
+	tbl := []struct {
+		name         string
+		filter       candleFilter
+		nodes, files []string
+	}{
+		{name: "nodes", filter: candleFilter{nodes: map[string]bool{"n6.radio-t.com": true}}, nodes: []string{"n6.radio-t.com"}},
+		{name: "all node", filter: candleFilter{nodes: map[string]bool{"all": true}}, nodes: []string{"all"},
+			files: []string{"a.mp3", "b.ogg"}},
+		{name: "files", filter: candleFilter{exclude: matchers("*.ogg")}, files: []string{"a.mp3"}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.filter.applyListeners(listeners)
+			nodes, files := []string{}, []string{}
+			for name := range res.Nodes {
+				nodes = append(nodes, name)
+			}
+			for name := range res.Files {
+				files = append(files, name)
+			}
+			assert.ElementsMatch(t, tt.nodes, nodes)
+			assert.ElementsMatch(t, tt.files, files)
+		})
+	}
+}
+
+func TestCandleFilter_Requests(t *testing.T) {
+	c := store.Candle{
+		Nodes:    map[string]store.Info{"n6.radio-t.com": {Volume: 1, Files: map[string]int{"a.mp3": 1}}},
+		Requests: map[string]int{"n6.radio-t.com": 2, "n7.radio-t.com": 1, "all": 3},
+	}
+
+	res, ok := candleFilter{nodes: map[string]bool{"n7.radio-t.com": true}}.applyCandle(c)
+	assert.True(t, ok, "candle with requests only is kept")
+	assert.Empty(t, res.Nodes)
+	assert.Equal(t, map[string]int{"n7.radio-t.com": 1}, res.Requests)
+
+	matchers, err := parseFileMatchers([]string{"a.mp3"})
+	require.NoError(t, err)
+	res, ok = candleFilter{include: matchers}.applyCandle(c)
+	assert.True(t, ok)
+	assert.Nil(t, res.Requests, "requests are not counted by file")
+}
+
+func TestCandleFilter_Countries(t *testing.T) {
+	c := store.Candle{
+		Nodes: map[string]store.Info{"n6.radio-t.com": {Volume: 5, Files: map[string]int{"a.mp3": 5}},
+			"all": {Volume: 5, Files: map[string]int{"a.mp3": 5}}},
+		Countries: map[string]int{"US": 3, "GB": 1},
+		Regions:   map[string]int{"US-CA": 2, "US-NY": 1, "GB-ENG": 1},
+		Requests:  map[string]int{"n6.radio-t.com": 6, "all": 6},
+		ASNs:      map[string]int{"AS64512 Test Net": 4},
+	}
+
+	res, ok := candleFilter{countries: map[string]bool{"US": true}}.applyCandle(c)
+	assert.True(t, ok)
+	assert.Equal(t, store.Candle{Nodes: map[string]store.Info{"all": {Volume: 3, Files: map[string]int{}}},
+		Countries: map[string]int{"US": 3}, Regions: map[string]int{"US-CA": 2, "US-NY": 1}}, res)
+
+	_, ok = candleFilter{countries: map[string]bool{"FR": true}}.applyCandle(c)
+	assert.False(t, ok, "no downloads from the country")
+	_, ok = candleFilter{countries: map[string]bool{"US": true}, nodes: map[string]bool{"n6.radio-t.com": true}}.applyCandle(c)
+	assert.False(t, ok, "nodes are not counted by country")
+
+	res, ok = candleFilter{nodes: map[string]bool{"n6.radio-t.com": true}}.applyCandle(c)
+	assert.True(t, ok)
+	assert.Nil(t, res.Countries, "locations are counted for all nodes only")
+	assert.Nil(t, res.ASNs)
+	res, ok = candleFilter{nodes: map[string]bool{"all": true}}.applyCandle(c)
+	assert.True(t, ok)
+	assert.Equal(t, c.Countries, res.Countries)
+	assert.Equal(t, c.Regions, res.Regions)
+	assert.Equal(t, c.ASNs, res.ASNs)
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/geo"
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// GeoLocator looks up location of client IP
+type GeoLocator interface {
+	Location(ip string) (geo.Location, error)
+}
+
+// ASNLocator looks up autonomous system of client IP
+type ASNLocator interface {
+	ASN(ip string) (geo.ASN, error)
+}
+
+// geoReport contains downloads by location for a period
+type geoReport struct {
+	From      time.Time  `json:"from"`
+	To        time.Time  `json:"to"`
+	Volume    int        `json:"volume"`    // downloads with known country
+	Countries []geoCount `json:"countries"` // downloads by country, ordered by count
+	Regions   []geoCount `json:"regions"`   // downloads by region, ordered by count
+}
+
+// geoCount contains downloads from a single location
+type geoCount struct {
+	Code    string  `json:"code"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"` // share of the location in downloads with known country
+}
+
+// loadGeo sums up downloads by country and region for [from, to) period
+func loadGeo(ctx context.Context, engine store.Engine, from, to time.Time) (geoReport, error) {
+	total, err := sumDimensions(ctx, engine, from, to, func(c store.Candle) store.Candle {
+		return store.Candle{Countries: c.Countries, Regions: c.Regions}
+	})
+	if err != nil {
+		return geoReport{}, err
+	}
+
+	res := geoReport{From: from, To: to, Countries: []geoCount{}, Regions: []geoCount{}}
+	for _, count := range total.Countries {
+		res.Volume += count
+	}
+	counts := func(m map[string]int) []geoCount {
+		res := make([]geoCount, 0, len(m))
+		for _, f := range store.TopCounts(m, len(m)) {
+			res = append(res, geoCount{Code: f.Key, Count: f.Count})
+		}
+		return res
+	}
+	res.Countries, res.Regions = counts(total.Countries), counts(total.Regions)
+	for _, list := range [][]geoCount{res.Countries, res.Regions} {
+		for i := range list {
+			list[i].Percent = 100 * float64(list[i].Count) / float64(res.Volume)
+		}
+	}
+	return res, nil
+}
+
+// locate returns log record with location of its client IP set by Geo and autonomous system set by ASN,
+// if they are set. Fields which can't be looked up are left empty.
+func (s *Server) locate(l store.LogRecord) store.LogRecord {
+	if s.Geo != nil {
+		if loc, err := s.Geo.Location(l.FromIP); err == nil {
+			l.Country, l.Region = loc.Country, loc.Region
+		}
+	}
+	if s.ASN != nil {
+		if asn, err := s.ASN.ASN(l.FromIP); err == nil {
+			l.ASN = asn.String()
+		}
+	}
+	return l
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/geo"
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// mockLocator locates IPs by the table, other IPs are not found
+type mockLocator map[string]geo.Location
+
+func (m mockLocator) Location(ip string) (geo.Location, error) {
+	if ip == "bad" {
+		return geo.Location{}, errors.New("bad ip")
+	}
+	return m[ip], nil
+}
+
+func TestLoadGeo(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := &goodDB{saved: []store.Candle{
+		{Nodes: storedCandle.Nodes, StartMinute: from, Countries: map[string]int{"US": 3, "GB": 1}, Regions: map[string]int{"US-CA": 2}},
+		{Nodes: storedCandle.Nodes, StartMinute: from.Add(24 * time.Hour)}, // stored without locations
+		{Nodes: storedCandle.Nodes, StartMinute: from.Add(48 * time.Hour), Countries: map[string]int{"GB": 3, "DE": 1},
+			Regions: map[string]int{"GB-ENG": 3}},
+	}}
+
+	res, err := loadGeo(context.Background(), db, from, from.Add(72*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, geoReport{From: from, To: from.Add(72 * time.Hour), Volume: 8,
+		Countries: []geoCount{{Code: "GB", Count: 4, Percent: 50}, {Code: "US", Count: 3, Percent: 37.5}, {Code: "DE", Count: 1, Percent: 12.5}},
+		Regions:   []geoCount{{Code: "GB-ENG", Count: 3, Percent: 37.5}, {Code: "US-CA", Count: 2, Percent: 25}},
+	}, res)
+	assert.Equal(t, []time.Duration{24 * time.Hour}, db.resolutions, "daily rollups for whole days")
+
+	res, err = loadGeo(context.Background(), &goodDB{}, from, from.Add(90*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, geoReport{From: from, To: from.Add(90 * time.Minute), Countries: []geoCount{}, Regions: []geoCount{}}, res)
+}
+
+func TestServerInsertGeo(t *testing.T) {
+	aggregator := &store.Aggregator{}
+	privacy, err := NewPrivacy("truncate", 24, 48)
+	require.NoError(t, err)
+	db := &goodDB{}
+	srv := &Server{Engine: db, Aggregator: aggregator, Privacy: privacy, Geo: mockLocator{
+		"81.2.69.142": {Country: "GB", Region: "GB-ENG"},
+		"81.2.70.1":   {Country: "US"},
+	}}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, ip := range []string{"81.2.69.142", "81.2.70.1", "127.0.0.1"} {
+		resp, err := http.Post(ts.URL+"/api/insert", "application/json", strings.NewReader(
+			`{"from_ip":"`+ip+`","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode, ip)
+	}
+	candles := aggregator.Flush()
+	require.Len(t, candles, 1)
+	assert.Equal(t, 3, candles[0].Nodes["all"].Volume)
+	assert.Equal(t, map[string]int{"GB": 1, "US": 1}, candles[0].Countries, "located before anonymization")
+	assert.Equal(t, map[string]int{"GB-ENG": 1}, candles[0].Regions)
+	assert.Equal(t, store.LogRecord{FromIP: "bad"}, srv.locate(store.LogRecord{FromIP: "bad"}), "located with error")
+
+	require.NoError(t, srv.saveCandles(candles))
+	resp, err := http.Get(ts.URL + "/api/geo?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	res := geoReport{}
+	require.NoError(t, json.Unmarshal(body, &res))
+	assert.Equal(t, 2, res.Volume)
+	assert.Equal(t, []geoCount{{Code: "GB", Count: 1, Percent: 50}, {Code: "US", Count: 1, Percent: 50}}, res.Countries)
+}
@@ -2,54 +2,259 @@ package web
 
 import (
 	"context"
-	"sort"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
 	"time"
 
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
 	"github.com/umputun/rlb-stats/app/store"
 )
 
-// loadCandles loads candles for given period of time aggregated by given duration
+// aggregation defines how loaded candles are aggregated, by duration or by calendar interval
+type aggregation struct {
+	duration time.Duration
+	calendar *calendarInterval // set for aggregation by calendar interval
+}
+
+// parseAggregation parses optional 'aggregate', 'max_points' and 'tz' query parameters for given period,
+// by default the period is split into 100 intervals. Sends error response and returns false if parameters are invalid.
+func parseAggregation(w http.ResponseWriter, r *http.Request, from, to time.Time) (aggregation, bool) {
+	var err error
+	loc := from.Location()
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'tz' field")
+			return aggregation{}, false
+		}
+	}
+	agg := aggregation{duration: roundToResolution(to.Sub(from).Truncate(time.Second) / 100)}
+	if a := r.URL.Query().Get("aggregate"); a != "" {
+		calendar, isCalendar, err := parseCalendarInterval(a, loc)
+		if isCalendar {
+			agg.calendar = &calendar
+		} else {
+			agg.duration, err = time.ParseDuration(a)
+		}
+		if err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'aggregate' field")
+			return aggregation{}, false
+		}
+	}
+	if n := r.URL.Query().Get("max_points"); n != "" {
+		i, err := strconv.ParseInt(n, 10, 8)
+		if err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'max_points' field")
+			return aggregation{}, false
+		}
+		agg = aggregation{duration: roundToResolution(to.Sub(from).Truncate(time.Second) / time.Duration(i))}
+	}
+	return agg, true
+}
+
+// loadAggregated loads candles for given period of time, filters and aggregates them
+func loadAggregated(ctx context.Context, engine store.Engine, from time.Time, to time.Time,
+	agg aggregation, filter candleFilter) ([]store.Candle, error) {
+	if agg.calendar != nil {
+		return loadCalendarCandles(ctx, engine, from, to, *agg.calendar, filter)
+	}
+	return loadCandles(ctx, engine, from, to, agg.duration, filter)
+}
+
+// rollupResolutions lists resolutions stored by engine besides minutes, from the coarsest one
+var rollupResolutions = []time.Duration{24 * time.Hour, time.Hour}
+
+// loadCandles loads candles for given period of time, filters and aggregates them by given duration.
+// Candles are loaded with the coarsest stored resolution which aggregation duration is a multiple of,
+// aggregation intervals are aligned to from truncated to that resolution, so the first and the last
+// intervals can be partial.
 func loadCandles(ctx context.Context, engine store.Engine, from time.Time, to time.Time,
-	aggDuration time.Duration) ([]store.Candle, error) {
+	aggDuration time.Duration, filter candleFilter) ([]store.Candle, error) {
 
-	candles, err := engine.Load(ctx, from, to)
+	resolution := time.Minute
+	for _, r := range rollupResolutions {
+		if aggDuration >= r && aggDuration%r == 0 {
+			resolution = r
+			break
+		}
+	}
+	// aggregated even with duration of the resolution, as partial intervals at the edges are read as finer candles
+	agg := newDurationAggregator(from.Truncate(resolution), aggDuration)
+	err := iterateCandles(ctx, engine, from, to, resolution, filter, func(c store.Candle) error {
+		agg.add(c)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if aggDuration != time.Minute {
-		candles = aggregateCandles(ctx, candles, aggDuration)
+	return agg.candles(), nil
+}
+
+// iterateCandles calls fn for filtered candles of given resolution, streaming them from engine
+func iterateCandles(ctx context.Context, engine store.Engine, from, to time.Time, resolution time.Duration,
+	filter candleFilter, fn func(store.Candle) error) error {
+	return engine.Iterate(ctx, from, to, resolution, func(c store.Candle) error {
+		if c, ok := filter.applyCandle(c); ok {
+			return fn(c)
+		}
+		return nil
+	})
+}
+
+// sumDimensions sums up candle dimensions picked by dims, like countries or autonomous systems, for [from, to)
+// period, streaming candles with the coarsest resolution both ends are aligned to
+func sumDimensions(ctx context.Context, engine store.Engine, from, to time.Time,
+	dims func(store.Candle) store.Candle) (store.Candle, error) {
+	total := store.NewCandle()
+	err := iterateCandles(ctx, engine, from, to.Add(-time.Second), periodResolution(from, to), candleFilter{},
+		func(c store.Candle) error {
+			total.Merge(dims(c))
+			return nil
+		})
+	return total, err
+}
+
+// roundToResolution rounds calculated aggregation duration up to whole hours or days once it exceeds them,
+// so candles for long periods are loaded from rollups instead of minute candles
+func roundToResolution(aggDuration time.Duration) time.Duration {
+	for _, r := range rollupResolutions {
+		if aggDuration > r {
+			return (aggDuration + r - 1).Truncate(r)
+		}
+	}
+	return aggDuration
+}
+
+// parsePeriod parses required 'from' and optional 'to' query parameters in RFC3339 format, 'to' defaults to now.
+// Sends error response and returns false if parameters are invalid.
+func parsePeriod(w http.ResponseWriter, r *http.Request) (from, to time.Time, ok bool) {
+	fromStr := r.URL.Query().Get("from")
+	if fromStr == "" {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no 'from' field passed"), "no 'from' field passed")
+		return from, to, false
+	}
+	from, err := time.Parse(time.RFC3339, fromStr)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'from' field")
+		return from, to, false
+	}
+	to = time.Now()
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'to' field")
+			return from, to, false
+		}
 	}
-	return candles, nil
+	return from, to, true
+}
+
+// parseFilesLimit parses optional 'files' query parameter with number of top files, 10 by default.
+// Sends error response and returns false if parameter is invalid.
+func parseFilesLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	return parseTopLimit(w, r, "files")
 }
 
-// saveLogRecord saves a log record to candle
-func saveLogRecord(engine store.Engine, parser LogAggregator, l store.LogRecord) error {
-	if candle, ok := parser.Store(l); ok { // Store returns ok in case candle is ready
-		return engine.Save(candle)
+// parseTopLimit parses optional query parameter with number of top entries, 10 by default.
+// Sends error response and returns false if parameter is invalid.
+func parseTopLimit(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 10, true
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative number of %s", name)
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, fmt.Sprintf("can't parse '%s' field", name))
+		return 0, false
+	}
+	return n, true
+}
+
+// validateLogRecord checks that all LogRecord fields required for aggregation are set
+func validateLogRecord(l store.LogRecord) error {
+	switch {
+	case l.Date.Equal(time.Time{}):
+		return missingFieldError("ts")
+	case l.DestHost == "":
+		return missingFieldError("dest")
+	case l.FileName == "":
+		return missingFieldError("file_name")
+	case l.FromIP == "":
+		return missingFieldError("from_ip")
 	}
 	return nil
 }
 
-// limitCandleFiles limit files in each node and keep only top N files
-func limitCandleFiles(candles []store.Candle, filesLimit int) []store.Candle {
+// missingFieldError is returned by validateLogRecord for a record without required field
+type missingFieldError string
+
+func (e missingFieldError) Error() string {
+	return "missing field in JSON: " + string(e)
+}
 
-	type fileInfo struct {
-		name  string
-		count int
+// rejectReason returns reason of log record rejection for metrics, from error returned by validation or saving
+func rejectReason(err error) string {
+	var missing missingFieldError
+	switch {
+	case errors.As(err, &missing):
+		return "missing_" + string(missing)
+	case errors.Is(err, store.ErrTooLate):
+		return "too_late"
+	case errors.Is(err, store.ErrTooEarly):
+		return "too_early"
+	case errors.Is(err, errForbiddenDest):
+		return "forbidden_dest"
+	case errors.Is(err, errBadFromIP):
+		return "bad_from_ip"
+	default:
+		return "save_error"
 	}
+}
+
+// anonymize returns log record with client IP anonymized by Privacy, if set
+func (s *Server) anonymize(l store.LogRecord) (store.LogRecord, error) {
+	if s.Privacy == nil {
+		return l, nil
+	}
+	return s.Privacy.anonymize(l, time.Now())
+}
+
+// saveLogRecord passes a log record to aggregator and saves candles it emitted
+func (s *Server) saveLogRecord(l store.LogRecord) error {
+	candles, err := s.Aggregator.Store(l)
+	if err != nil {
+		return err
+	}
+	return s.saveCandles(candles)
+}
 
-	flatFiles := func(files map[string]int) []fileInfo {
-		var res []fileInfo
-		for k, v := range files {
-			res = append(res, fileInfo{k, v})
+// saveCandles saves candles emitted by aggregator, engine merges them with already stored ones.
+// Saved candles are counted in metrics and sent to stream clients.
+func (s *Server) saveCandles(candles []store.Candle) error {
+	for i, c := range candles {
+		if err := s.Engine.Save(c); err != nil {
+			s.metrics.addCandles(candles[:i], s.MetricsFiles)
+			s.stream.publish(candles[:i])
+			return err
 		}
-		return res
 	}
+	s.metrics.addCandles(candles, s.MetricsFiles)
+	s.stream.publish(candles)
+	return nil
+}
 
-	mapFiles := func(files []fileInfo) map[string]int {
+// limitCandleFiles limit files in each node and keep only top N files
+func limitCandleFiles(candles []store.Candle, filesLimit int) []store.Candle {
+
+	mapFiles := func(files []store.KeyCount) map[string]int {
 		res := make(map[string]int)
 		for _, v := range files {
-			res[v.name] = v.count
+			res[v.Key] = v.Count
 		}
 		return res
 	}
@@ -60,19 +265,16 @@ func limitCandleFiles(candles []store.Candle, filesLimit int) []store.Candle {
 		candle := store.Candle{
 			Nodes:       make(map[string]store.Info),
 			StartMinute: c.StartMinute,
+			Requests:    c.Requests,
+			Countries:   c.Countries,
+			Regions:     c.Regions,
+			ASNs:        c.ASNs,
 		}
 
 		for name, node := range c.Nodes {
-			files := flatFiles(node.Files)
-			sort.Slice(files, func(i, j int) bool {
-				return files[i].count > files[j].count
-			})
-			if len(files) > filesLimit {
-				files = files[:filesLimit]
-			}
 			candle.Nodes[name] = store.Info{
 				Volume: node.Volume,
-				Files:  mapFiles(files),
+				Files:  mapFiles(store.TopCounts(node.Files, filesLimit)),
 			}
 		}
 		res = append(res, candle)
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/rlb-stats/app/store"
 )
@@ -18,22 +19,104 @@ func TestLoadCandles(t *testing.T) {
 	ctx := context.Background()
 
 	// load empty results
-	result, err := loadCandles(ctx, e, time.Time{}, time.Time{}.Add(time.Minute), time.Nanosecond)
+	result, err := loadCandles(ctx, e, time.Time{}, time.Time{}.Add(time.Minute), time.Nanosecond, candleFilter{})
 	assert.Nil(t, err)
 	assert.Equal(t, []store.Candle{}, result)
 
 	// load non-empty results
-	result, err = loadCandles(ctx, e, time.Unix(0, 0), time.Unix(0, 0).Add(time.Minute), time.Nanosecond)
+	result, err = loadCandles(ctx, e, time.Unix(0, 0), time.Unix(0, 0).Add(time.Minute), time.Nanosecond, candleFilter{})
 	assert.Nil(t, err)
 	assert.Equal(t, []store.Candle{storedCandle}, result)
 
 	badE, _ := startupEngine(t, true)
 	// load from non-existent files
-	result, err = loadCandles(ctx, badE, time.Unix(0, 0), time.Unix(0, 0).Add(time.Minute), time.Nanosecond)
+	result, err = loadCandles(ctx, badE, time.Unix(0, 0), time.Unix(0, 0).Add(time.Minute), time.Nanosecond, candleFilter{})
 	assert.Nil(t, result)
 	assert.EqualError(t, err, "test error")
 }
 
+func TestLoadCandlesResolution(t *testing.T) {
+	tbl := []struct {
+		agg, res time.Duration
+	}{
+		{agg: time.Minute, res: time.Minute},
+		{agg: 15 * time.Minute, res: time.Minute},
+		{agg: 90 * time.Minute, res: time.Minute},
+		{agg: time.Hour, res: time.Hour},
+		{agg: 8 * time.Hour, res: time.Hour},
+		{agg: 36 * time.Hour, res: time.Hour},
+		{agg: 24 * time.Hour, res: 24 * time.Hour},
+		{agg: 7 * 24 * time.Hour, res: 24 * time.Hour},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.agg.String(), func(t *testing.T) {
+			db := &goodDB{}
+			_, err := loadCandles(context.Background(), db, time.Unix(0, 0), time.Unix(0, 0).Add(time.Hour), tt.agg, candleFilter{})
+			require.NoError(t, err)
+			assert.Equal(t, []time.Duration{tt.res}, db.resolutions)
+		})
+	}
+}
+
+func TestLoadCandlesPartialRollups(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	engine, err := store.NewBolt(file.Name())
+	require.NoError(t, err)
+	defer engine.Close()
+
+	// one download every minute for 3 hours
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i := range 180 {
+		c := store.NewCandle()
+		c.Update(store.LogRecord{FromIP: "127.0.0.1", FileName: "/rtfiles/rt_podcast561.mp3", DestHost: "n6.radio-t.com",
+			Date: start.Add(time.Duration(i) * time.Minute)})
+		require.NoError(t, engine.Save(c))
+	}
+
+	// both ends of the period fall inside an hour
+	from, to := start.Add(30*time.Minute), start.Add(150*time.Minute)
+	tbl := []struct {
+		agg     time.Duration
+		volumes map[time.Time]int
+	}{
+		{agg: 30 * time.Minute, volumes: map[time.Time]int{from: 30, start.Add(time.Hour): 30, start.Add(90 * time.Minute): 30,
+			start.Add(2 * time.Hour): 30, to: 1}},
+		{agg: time.Hour, volumes: map[time.Time]int{start: 30, start.Add(time.Hour): 60, start.Add(2 * time.Hour): 31}},
+		{agg: 2 * time.Hour, volumes: map[time.Time]int{start: 90, start.Add(2 * time.Hour): 31}},
+		{agg: 24 * time.Hour, volumes: map[time.Time]int{start.Truncate(24 * time.Hour): 121}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.agg.String(), func(t *testing.T) {
+			candles, err := loadCandles(context.Background(), engine, from, to, tt.agg, candleFilter{})
+			require.NoError(t, err)
+			volumes := map[time.Time]int{}
+			for _, c := range candles {
+				volumes[c.StartMinute.UTC()] = c.Nodes["all"].Volume
+			}
+			assert.Equal(t, tt.volumes, volumes)
+		})
+	}
+}
+
+func TestRoundToResolution(t *testing.T) {
+	tbl := []struct {
+		in, out time.Duration
+	}{
+		{in: 0, out: 0},
+		{in: 14*time.Minute + 24*time.Second, out: 14*time.Minute + 24*time.Second},
+		{in: time.Hour, out: time.Hour},
+		{in: 100 * time.Minute, out: 2 * time.Hour},
+		{in: 7*time.Hour + 12*time.Minute, out: 8 * time.Hour},
+		{in: 24 * time.Hour, out: 24 * time.Hour},
+		{in: 87*time.Hour + 36*time.Minute, out: 4 * 24 * time.Hour},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.out, roundToResolution(tt.in), tt.in.String())
+	}
+}
+
 func Test_limitCandleFiles(t *testing.T) {
 	candle1 := store.Candle{
 		Nodes: map[string]store.Info{
@@ -127,19 +210,29 @@ func (m MockDB) Load(ctx context.Context, periodStart, periodEnd time.Time) ([]s
 	return nil, errors.New("test error")
 }
 
+func (m MockDB) Iterate(ctx context.Context, periodStart, periodEnd time.Time, resolution time.Duration,
+	fn func(store.Candle) error) error {
+	return errors.New("test error")
+}
+
 // mockAggregator implements LogAggregator with configurable return values
 type mockAggregator struct {
-	candle store.Candle
-	ok     bool
+	candles []store.Candle
+	err     error
 }
 
-func (m *mockAggregator) Store(store.LogRecord) (store.Candle, bool) {
-	return m.candle, m.ok
+func (m *mockAggregator) Store(store.LogRecord) ([]store.Candle, error) {
+	return m.candles, m.err
+}
+
+func (m *mockAggregator) FlushBefore(time.Time) []store.Candle {
+	return m.candles
 }
 
 // goodDB implements store.Engine with successful Save
 type goodDB struct {
-	saved []store.Candle
+	saved       []store.Candle
+	resolutions []time.Duration // requested by Iterate
 }
 
 func (g *goodDB) Save(candle store.Candle) error {
@@ -151,6 +244,17 @@ func (g *goodDB) Load(ctx context.Context, periodStart, periodEnd time.Time) ([]
 	return g.saved, nil
 }
 
+func (g *goodDB) Iterate(ctx context.Context, periodStart, periodEnd time.Time, resolution time.Duration,
+	fn func(store.Candle) error) error {
+	g.resolutions = append(g.resolutions, resolution)
+	for _, c := range g.saved {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func TestSaveLogRecord(t *testing.T) {
 	testCandle := store.Candle{
 		Nodes: map[string]store.Info{
@@ -161,25 +265,84 @@ func TestSaveLogRecord(t *testing.T) {
 
 	t.Run("aggregator returns candle, save succeeds", func(t *testing.T) {
 		db := &goodDB{}
-		agg := &mockAggregator{candle: testCandle, ok: true}
-		err := saveLogRecord(db, agg, store.LogRecord{})
+		srv := Server{Engine: db, Aggregator: &mockAggregator{candles: []store.Candle{testCandle}}}
+		err := srv.saveLogRecord(store.LogRecord{})
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(db.saved))
 		assert.Equal(t, testCandle, db.saved[0])
 	})
 
 	t.Run("aggregator returns candle, save fails", func(t *testing.T) {
-		db := MockDB{} // always returns error
-		agg := &mockAggregator{candle: testCandle, ok: true}
-		err := saveLogRecord(db, agg, store.LogRecord{})
+		srv := Server{Engine: MockDB{}, Aggregator: &mockAggregator{candles: []store.Candle{testCandle}}}
+		err := srv.saveLogRecord(store.LogRecord{})
 		assert.EqualError(t, err, "test error")
 	})
 
 	t.Run("aggregator does not return candle", func(t *testing.T) {
 		db := &goodDB{}
-		agg := &mockAggregator{candle: store.Candle{}, ok: false}
-		err := saveLogRecord(db, agg, store.LogRecord{})
+		srv := Server{Engine: db, Aggregator: &mockAggregator{}}
+		err := srv.saveLogRecord(store.LogRecord{})
 		assert.NoError(t, err)
 		assert.Equal(t, 0, len(db.saved), "no save should be attempted")
 	})
+
+	t.Run("aggregator returns error", func(t *testing.T) {
+		db := &goodDB{}
+		srv := Server{Engine: db, Aggregator: &mockAggregator{err: store.ErrTooLate}}
+		err := srv.saveLogRecord(store.LogRecord{})
+		assert.ErrorIs(t, err, store.ErrTooLate)
+		assert.Equal(t, 0, len(db.saved), "no save should be attempted")
+	})
+}
+
+func TestSaveCandlesMergesStored(t *testing.T) {
+	e, teardown := startupEngine(t, false)
+	defer teardown()
+	srv := Server{Engine: e}
+
+	late := store.Candle{
+		Nodes: map[string]store.Info{
+			"n7.radio-t.com": {Volume: 1, Files: map[string]int{}},
+			"all":            {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+		},
+		StartMinute: storedCandle.StartMinute,
+	}
+	require.NoError(t, srv.saveCandles([]store.Candle{late}))
+
+	result, err := e.Load(context.Background(), storedCandle.StartMinute, storedCandle.StartMinute)
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, map[string]store.Info{
+		"n6.radio-t.com": {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1}},
+		"n7.radio-t.com": {Volume: 1, Files: map[string]int{}},
+		"all":            {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2}},
+	}, result[0].Nodes)
+}
+
+func TestIterateCandles(t *testing.T) {
+	storage, teardown := startupEngine(t, false)
+	defer teardown()
+	var candles []store.Candle
+	err := iterateCandles(context.Background(), storage, time.Unix(0, 0), time.Unix(60, 0), time.Minute, candleFilter{},
+		func(c store.Candle) error {
+			candles = append(candles, c)
+			return nil
+		})
+	require.NoError(t, err)
+	require.Len(t, candles, 1)
+	assert.Equal(t, storedCandle.Nodes, candles[0].Nodes)
+
+	err = iterateCandles(context.Background(), storage, time.Unix(0, 0), time.Unix(60, 0), time.Minute, candleFilter{},
+		func(c store.Candle) error { return errors.New("write error") })
+	assert.EqualError(t, err, "write error")
+
+	candles = nil
+	filter := candleFilter{nodes: map[string]bool{"n7.radio-t.com": true}}
+	err = iterateCandles(context.Background(), storage, time.Unix(0, 0), time.Unix(60, 0), time.Minute, filter,
+		func(c store.Candle) error {
+			candles = append(candles, c)
+			return nil
+		})
+	require.NoError(t, err)
+	assert.Empty(t, candles, "candles without selected nodes skipped")
 }
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// maxLifecyclePoints limits length of a single lifecycle curve
+const maxLifecyclePoints = 1000
+
+// lifecycle contains cumulative downloads of a file relative to the moment it was first seen
+type lifecycle struct {
+	File      string    `json:"file"`
+	FirstSeen time.Time `json:"first_seen"`
+	Detected  bool      `json:"detected"` // first seen time detected from stored candles, not passed in request
+	Curve     []int     `json:"curve"`    // cumulative downloads by the end of each interval after first seen
+}
+
+// lifecycleRequest is a file with optional first seen time passed as name@RFC3339
+type lifecycleRequest struct {
+	file      string
+	firstSeen time.Time // zero if has to be detected
+}
+
+// parseLifecycleRequest parses file name with optional first seen time, like rt_podcast561.mp3@2024-01-01T10:00:00Z
+func parseLifecycleRequest(s string) lifecycleRequest {
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		if t, err := time.Parse(time.RFC3339, s[i+1:]); err == nil {
+			return lifecycleRequest{file: s[:i], firstSeen: t.Truncate(time.Minute)}
+		}
+	}
+	return lifecycleRequest{file: s}
+}
+
+// parseDays parses duration in days like 7d, or any duration in time.ParseDuration format
+func parseDays(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q: %w", s, err)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// errAllFound stops iteration over candles once the first candle of every file is found
+var errAllFound = errors.New("all files found")
+
+// detectFirstSeen finds the first minute each of the files was downloaded, files never downloaded before now
+// are omitted. Candles are scanned from daily to hourly to minute resolution, narrowing the period down to the
+// first candle containing the file, so precision is lower for periods where finer candles expired. Files narrowed
+// down to the same period are searched in a single pass over its candles.
+func detectFirstSeen(ctx context.Context, engine store.Engine, files []string, now time.Time) (map[string]time.Time, error) {
+	type period struct {
+		from, to time.Time
+	}
+	periods := map[string]period{}
+	for _, file := range files {
+		periods[file] = period{from: time.Unix(0, 0), to: now}
+	}
+
+	for _, resolution := range append(append([]time.Duration{}, rollupResolutions...), time.Minute) {
+		groups := map[period][]string{}
+		for file, p := range periods {
+			groups[p] = append(groups[p], file)
+		}
+		found := map[string]period{}
+		for p, group := range groups {
+			left := len(group)
+			err := engine.Iterate(ctx, p.from, p.to, resolution, func(c store.Candle) error {
+				for _, file := range group {
+					if _, ok := found[file]; !ok && c.Nodes["all"].Files[file] > 0 {
+						found[file] = period{from: c.StartMinute, to: c.StartMinute.Add(resolution - time.Second)}
+						left--
+					}
+				}
+				if left == 0 {
+					return errAllFound
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errAllFound) {
+				return nil, err
+			}
+		}
+		periods = found // files not found with coarser resolution are not searched further
+	}
+
+	res := map[string]time.Time{}
+	for file, p := range periods {
+		res[file] = p.from
+	}
+	return res, nil
+}
+
+// loadLifecycle loads cumulative downloads of the file for span after first seen, split by interval.
+// Only intervals started before now are returned. Candles are loaded with hourly resolution when interval is
+// a multiple of an hour, intervals start from the hour of first seen time in this case.
+func loadLifecycle(ctx context.Context, engine store.Engine, file string, firstSeen time.Time, interval, span time.Duration,
+	now time.Time) ([]int, error) {
+	resolution := time.Minute
+	if interval%time.Hour == 0 {
+		resolution = time.Hour
+	}
+	start := firstSeen.Truncate(resolution)
+	end := start.Add(span)
+	if now.Before(end) {
+		end = now
+	}
+
+	points := int((end.Sub(start) + interval - 1) / interval)
+	curve := make([]int, max(points, 0))
+	err := engine.Iterate(ctx, start, end.Add(-time.Second), resolution, func(c store.Candle) error {
+		n := int(c.StartMinute.Sub(start) / interval)
+		if n >= 0 && n < len(curve) {
+			curve[n] += c.Nodes["all"].Files[file]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(curve); i++ {
+		curve[i] += curve[i-1]
+	}
+	return curve, nil
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestParseLifecycleRequest(t *testing.T) {
+	assert.Equal(t, lifecycleRequest{file: "/rtfiles/rt_podcast561.mp3"}, parseLifecycleRequest("/rtfiles/rt_podcast561.mp3"))
+	assert.Equal(t, lifecycleRequest{file: "/rtfiles/rt_podcast561.mp3", firstSeen: time.Date(2024, 1, 1, 10, 5, 0, 0, time.UTC)},
+		parseLifecycleRequest("/rtfiles/rt_podcast561.mp3@2024-01-01T10:05:30Z"))
+	assert.Equal(t, lifecycleRequest{file: "/rtfiles/rt@podcast.mp3"}, parseLifecycleRequest("/rtfiles/rt@podcast.mp3"))
+}
+
+func TestParseDays(t *testing.T) {
+	for in, out := range map[string]time.Duration{"1d": 24 * time.Hour, "30d": 30 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		d, err := parseDays(in)
+		require.NoError(t, err)
+		assert.Equal(t, out, d, in)
+	}
+	_, err := parseDays("xd")
+	assert.Error(t, err)
+	_, err = parseDays("bad")
+	assert.Error(t, err)
+}
+
+func TestLifecycle(t *testing.T) {
+	file, err := os.CreateTemp("/tmp/", "bolt_test.bd.")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	engine, err := store.NewBolt(file.Name())
+	require.NoError(t, err)
+	defer engine.Close()
+
+	// rt_podcast561 released on Jan 1 10:37 and downloaded 10 times each hour for 3 days,
+	// rt_podcast562 released on Jan 8 20:00 and downloaded 5 times each hour for 2 days
+	release561 := time.Date(2024, 1, 1, 10, 37, 0, 0, time.UTC)
+	release562 := time.Date(2024, 1, 8, 20, 0, 0, 0, time.UTC)
+	save := func(name string, release time.Time, count int, span time.Duration) {
+		for ts := release; ts.Before(release.Add(span)); ts = ts.Add(time.Hour) {
+			c := store.NewCandle()
+			for i := range count {
+				c.Update(store.LogRecord{FileName: name, DestHost: "n6.radio-t.com", Date: ts, FromIP: string(rune('a' + i))})
+			}
+			require.NoError(t, engine.Save(c))
+		}
+	}
+	save("/rtfiles/rt_podcast561.mp3", release561, 10, 72*time.Hour)
+	save("/rtfiles/rt_podcast562.mp3", release562, 5, 48*time.Hour)
+
+	ctx := context.Background()
+	now := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	detected, err := detectFirstSeen(ctx, engine, []string{"/rtfiles/rt_podcast561.mp3", "/rtfiles/rt_podcast562.mp3",
+		"/rtfiles/rt_podcast563.mp3"}, now)
+	require.NoError(t, err)
+	require.Len(t, detected, 2)
+	assert.Equal(t, release561, detected["/rtfiles/rt_podcast561.mp3"].UTC())
+	assert.Equal(t, release562, detected["/rtfiles/rt_podcast562.mp3"].UTC())
+
+	curve, err := loadLifecycle(ctx, engine, "/rtfiles/rt_podcast561.mp3", release561, 24*time.Hour, 5*24*time.Hour, now)
+	require.NoError(t, err)
+	assert.Equal(t, []int{240, 480, 720, 720, 720}, curve)
+
+	curve, err = loadLifecycle(ctx, engine, "/rtfiles/rt_podcast562.mp3", release562, 12*time.Hour, 3*24*time.Hour, now)
+	require.NoError(t, err)
+	assert.Equal(t, []int{60, 120, 180, 240, 240, 240}, curve)
+
+	// minute intervals loaded from minute candles
+	curve, err = loadLifecycle(ctx, engine, "/rtfiles/rt_podcast561.mp3", release561, 30*time.Minute, 2*time.Hour, now)
+	require.NoError(t, err)
+	assert.Equal(t, []int{10, 10, 20, 20}, curve)
+
+	// only intervals started before now are returned
+	curve, err = loadLifecycle(ctx, engine, "/rtfiles/rt_podcast562.mp3", release562, 24*time.Hour, 30*24*time.Hour,
+		release562.Add(36*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []int{120, 180}, curve)
+
+	_, err = detectFirstSeen(ctx, MockDB{}, []string{"/rtfiles/rt_podcast561.mp3"}, now)
+	assert.EqualError(t, err, "test error")
+	_, err = loadLifecycle(ctx, MockDB{}, "/rtfiles/rt_podcast561.mp3", release561, time.Hour, time.Hour, now)
+	assert.EqualError(t, err, "test error")
+}
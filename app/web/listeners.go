@@ -0,0 +1,75 @@
+package web
+
+import (
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// listenersReport contains estimated numbers of unique listeners for a period
+type listenersReport struct {
+	From    time.Time         `json:"from"`
+	To      time.Time         `json:"to"`
+	Nodes   map[string]int    `json:"nodes"`   // unique listeners by node, including "all"
+	Files   []fileListeners   `json:"files"`   // top files by unique listeners
+	Buckets []bucketListeners `json:"buckets"` // unique listeners of selected nodes by aggregation interval
+}
+
+// fileListeners contains unique listeners of a single file
+type fileListeners struct {
+	Name      string `json:"name"`
+	Listeners int    `json:"listeners"`
+}
+
+// bucketListeners contains unique listeners for aggregation interval started at Start
+type bucketListeners struct {
+	Start     time.Time `json:"start"`
+	Listeners int       `json:"listeners"`
+}
+
+// countListeners merges listeners sketches of aggregated candles and estimates unique listeners by node,
+// by file, limited to filesLimit top files, and by candle. Candles without sketches are skipped.
+func countListeners(candles []store.Candle, filesLimit int) listenersReport {
+	res := listenersReport{Nodes: map[string]int{}, Files: []fileListeners{}, Buckets: []bucketListeners{}}
+	total := store.NewListeners()
+	for _, c := range candles {
+		if c.Listeners == nil {
+			continue
+		}
+		bucket := &store.HLL{}
+		for name, sketch := range c.Listeners.Nodes {
+			bucket.Merge(sketch)
+			if _, ok := total.Nodes[name]; !ok {
+				total.Nodes[name] = &store.HLL{}
+			}
+			total.Nodes[name].Merge(sketch)
+		}
+		for file, sketch := range c.Listeners.Files {
+			if _, ok := total.Files[file]; !ok {
+				total.Files[file] = &store.HLL{}
+			}
+			total.Files[file].Merge(sketch)
+		}
+		res.Buckets = append(res.Buckets, bucketListeners{Start: c.StartMinute, Listeners: bucket.Count()})
+	}
+
+	for name, sketch := range total.Nodes {
+		res.Nodes[name] = sketch.Count()
+	}
+	files := make(map[string]int, len(total.Files))
+	for file, sketch := range total.Files {
+		files[file] = sketch.Count()
+	}
+	for _, f := range store.TopCounts(files, filesLimit) {
+		res.Files = append(res.Files, fileListeners{Name: f.Key, Listeners: f.Count})
+	}
+	return res
+}
+
+// dropListeners removes listeners sketches from candles, which are reported by /api/listeners only
+func dropListeners(candles []store.Candle) []store.Candle {
+	for i := range candles {
+		candles[i].Listeners = nil
+	}
+	return candles
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestCountListeners(t *testing.T) {
+	candle := func(start time.Time, records ...store.LogRecord) store.Candle {
+		c := store.NewCandle()
+		for _, l := range records {
+			c.Update(l)
+			c.UpdateListeners(l)
+		}
+		c.StartMinute = start
+		return c
+	}
+	candles := []store.Candle{
+		candle(time.Unix(0, 0),
+			store.LogRecord{FromIP: "127.0.0.1", FileName: "a.mp3", DestHost: "n6.radio-t.com"},
+			store.LogRecord{FromIP: "127.0.0.2", FileName: "a.mp3", DestHost: "n6.radio-t.com"},
+			store.LogRecord{FromIP: "127.0.0.1", FileName: "b.mp3", DestHost: "n7.radio-t.com"},
+		),
+		{Nodes: storedCandle.Nodes, StartMinute: time.Unix(3600, 0)}, // stored without listeners
+		candle(time.Unix(7200, 0),
+			store.LogRecord{FromIP: "127.0.0.1", FileName: "a.mp3", DestHost: "n6.radio-t.com"},
+			store.LogRecord{FromIP: "127.0.0.3", FileName: "c.mp3", DestHost: "n6.radio-t.com"},
+		),
+	}
+
+	res := countListeners(candles, 2)
+	assert.Equal(t, map[string]int{"all": 3, "n6.radio-t.com": 3, "n7.radio-t.com": 1}, res.Nodes)
+	assert.Equal(t, []fileListeners{{Name: "a.mp3", Listeners: 2}, {Name: "b.mp3", Listeners: 1}}, res.Files)
+	assert.Equal(t, []bucketListeners{{Start: time.Unix(0, 0), Listeners: 2}, {Start: time.Unix(7200, 0), Listeners: 2}},
+		res.Buckets)
+
+	res = countListeners(nil, 10)
+	assert.Equal(t, listenersReport{Nodes: map[string]int{}, Files: []fileListeners{}, Buckets: []bucketListeners{}}, res)
+
+	// filtered and aggregated candles
+	filter := candleFilter{nodes: map[string]bool{"n6.radio-t.com": true}}
+	aggregated := aggregate(newDurationAggregator(time.Unix(0, 0), 24*time.Hour), filter.apply(candles))
+	res = countListeners(aggregated, 10)
+	assert.Equal(t, map[string]int{"n6.radio-t.com": 3}, res.Nodes)
+	assert.Empty(t, res.Files, "file sketches are for all nodes")
+	assert.Equal(t, []bucketListeners{{Start: time.Unix(0, 0), Listeners: 3}}, res.Buckets)
+
+	assert.Nil(t, dropListeners(candles)[0].Listeners)
+}
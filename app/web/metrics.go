@@ -0,0 +1,147 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// otherFiles is the file label of downloads counted after MetricsFiles distinct files seen
+const otherFiles = "other"
+
+// bufferReporter is implemented by aggregators which report size of buffered data
+type bufferReporter interface {
+	BufferSize() (minutes, keys int)
+}
+
+// storageReporter is implemented by engines which report size of the storage
+type storageReporter interface {
+	StorageStats() (store.StorageStats, error)
+}
+
+// downloadMetrics counts downloads of saved candles and ingested log records since the start.
+// Zero value is ready to use.
+type downloadMetrics struct {
+	mu       sync.Mutex
+	nodes    map[string]int // downloads by node, "all" node excluded
+	files    map[string]int // downloads by file, for limited number of files
+	other    int            // downloads of files over the limit
+	accepted int            // log records passed validation and stored by aggregator
+	rejected map[string]int // log records rejected, by reason
+}
+
+// addCandles counts downloads of saved candles. Only the first filesLimit distinct files are counted
+// separately, downloads of files seen after that are counted as otherFiles. New files of the same candle
+// take free places in order of names.
+func (m *downloadMetrics) addCandles(candles []store.Candle, filesLimit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.nodes == nil {
+		m.nodes, m.files = map[string]int{}, map[string]int{}
+	}
+	for _, c := range candles {
+		for name, node := range c.Nodes {
+			if name != "all" {
+				m.nodes[name] += node.Volume
+				continue
+			}
+			var newFiles []string
+			for file, count := range node.Files {
+				if _, ok := m.files[file]; ok {
+					m.files[file] += count
+					continue
+				}
+				newFiles = append(newFiles, file)
+			}
+			sort.Strings(newFiles)
+			for _, file := range newFiles {
+				if len(m.files) >= filesLimit {
+					m.other += node.Files[file]
+					continue
+				}
+				m.files[file] = node.Files[file]
+			}
+		}
+	}
+}
+
+// accept counts accepted log record
+func (m *downloadMetrics) accept() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accepted++
+}
+
+// reject counts rejected log record with given reason
+func (m *downloadMetrics) reject(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rejected == nil {
+		m.rejected = map[string]int{}
+	}
+	m.rejected[reason]++
+}
+
+// metricsWriter writes metrics in Prometheus text exposition format, keeping the first error
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// header writes HELP and TYPE lines of the metric
+func (mw *metricsWriter) header(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// value writes a sample without labels
+func (mw *metricsWriter) value(name string, v int64) {
+	mw.printf("%s %d\n", name, v)
+}
+
+// labeled writes samples with a single label, ordered by label value
+func (mw *metricsWriter) labeled(name, label string, values map[string]int) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.printf("%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), values[k])
+	}
+}
+
+func (mw *metricsWriter) printf(format string, args ...any) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+// escapeLabel escapes backslash, double quote and line feed in label value
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeTo writes counters in Prometheus text exposition format
+func (m *downloadMetrics) writeTo(mw *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mw.header("rlb_stats_node_downloads_total", "counter", "Downloads by node.")
+	mw.labeled("rlb_stats_node_downloads_total", "node", m.nodes)
+	mw.header("rlb_stats_file_downloads_total", "counter", "Downloads by file, files over the limit are counted as \"other\".")
+	files := m.files
+	if m.other > 0 {
+		files = maps.Clone(m.files)
+		files[otherFiles] += m.other
+	}
+	mw.labeled("rlb_stats_file_downloads_total", "file", files)
+	mw.header("rlb_stats_records_accepted_total", "counter", "Log records accepted by insert.")
+	mw.value("rlb_stats_records_accepted_total", int64(m.accepted))
+	mw.header("rlb_stats_records_rejected_total", "counter", "Log records rejected by insert, by reason.")
+	mw.labeled("rlb_stats_records_rejected_total", "reason", m.rejected)
+}
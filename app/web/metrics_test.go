@@ -0,0 +1,54 @@
+package web
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestDownloadMetrics(t *testing.T) {
+	m := downloadMetrics{}
+	m.addCandles([]store.Candle{
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 3},
+			"all":            {Volume: 3, Files: map[string]int{"b.mp3": 2, "a.mp3": 1}},
+		}, StartMinute: time.Unix(0, 0)},
+		{Nodes: map[string]store.Info{
+			"n7.radio-t.com": {Volume: 4},
+			"all":            {Volume: 4, Files: map[string]int{"c.mp3": 1, "b.mp3": 3}},
+		}, StartMinute: time.Unix(60, 0)},
+	}, 1)
+	m.accept()
+	m.reject("too_late")
+	m.reject("too_late")
+
+	buf := bytes.Buffer{}
+	mw := &metricsWriter{w: &buf}
+	m.writeTo(mw)
+	require.NoError(t, mw.err)
+	assert.Equal(t, `# HELP rlb_stats_node_downloads_total Downloads by node.
+# TYPE rlb_stats_node_downloads_total counter
+rlb_stats_node_downloads_total{node="n6.radio-t.com"} 3
+rlb_stats_node_downloads_total{node="n7.radio-t.com"} 4
+# HELP rlb_stats_file_downloads_total Downloads by file, files over the limit are counted as "other".
+# TYPE rlb_stats_file_downloads_total counter
+rlb_stats_file_downloads_total{file="a.mp3"} 1
+rlb_stats_file_downloads_total{file="other"} 6
+# HELP rlb_stats_records_accepted_total Log records accepted by insert.
+# TYPE rlb_stats_records_accepted_total counter
+rlb_stats_records_accepted_total 1
+# HELP rlb_stats_records_rejected_total Log records rejected by insert, by reason.
+# TYPE rlb_stats_records_rejected_total counter
+rlb_stats_records_rejected_total{reason="too_late"} 2
+`, buf.String())
+}
+
+func TestEscapeLabel(t *testing.T) {
+	assert.Equal(t, `rt_podcast561.mp3`, escapeLabel("rt_podcast561.mp3"))
+	assert.Equal(t, `a\\b\"c\nd`, escapeLabel("a\\b\"c\nd"))
+}
@@ -0,0 +1,92 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// errBadFromIP returned for log record which client IP can't be anonymized
+var errBadFromIP = errors.New("bad from_ip")
+
+// Privacy anonymizes client IPs of ingested log records before they reach the aggregator, so full IPs are never
+// kept. IPs are either truncated to network prefixes, or replaced with a keyed hash. Hash key is random, kept
+// in memory only and replaced by a new one at UTC midnight, so hashes of past days can't be reversed by trying
+// all addresses. The same IP is anonymized the same way within a day, so deduplication of records keeps working,
+// while downloads of the same client on different days, or after restart, are deduplicated and counted as unique
+// listeners separately. Safe for concurrent use.
+type Privacy struct {
+	IPv4Prefix int // bits of IPv4 address kept by truncation
+	IPv6Prefix int // bits of IPv6 address kept by truncation
+
+	hash bool // IPs are hashed instead of truncation
+
+	mu  sync.Mutex
+	day string // UTC day of the key
+	key []byte // random key of the day
+}
+
+// NewPrivacy makes Privacy for "truncate" or "hash" mode
+func NewPrivacy(mode string, ipv4Prefix, ipv6Prefix int) (*Privacy, error) {
+	switch mode {
+	case "truncate":
+		if ipv4Prefix < 0 || ipv4Prefix > 32 {
+			return nil, fmt.Errorf("bad IPv4 prefix %d, should be from 0 to 32", ipv4Prefix)
+		}
+		if ipv6Prefix < 0 || ipv6Prefix > 128 {
+			return nil, fmt.Errorf("bad IPv6 prefix %d, should be from 0 to 128", ipv6Prefix)
+		}
+		return &Privacy{IPv4Prefix: ipv4Prefix, IPv6Prefix: ipv6Prefix}, nil
+	case "hash":
+		return &Privacy{hash: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown privacy mode %q", mode)
+	}
+}
+
+// anonymize returns log record with client IP truncated, or hashed with the key of the current UTC day
+func (p *Privacy) anonymize(l store.LogRecord, now time.Time) (store.LogRecord, error) {
+	addr, err := netip.ParseAddr(l.FromIP)
+	if err != nil {
+		return l, fmt.Errorf("%w: %w", errBadFromIP, err)
+	}
+	addr = addr.Unmap().WithZone("")
+
+	if p.hash {
+		mac := hmac.New(sha256.New, p.dayKey(now))
+		_, _ = mac.Write(addr.AsSlice())
+		l.FromIP = hex.EncodeToString(mac.Sum(nil)[:16])
+		return l, nil
+	}
+
+	bits := p.IPv6Prefix
+	if addr.Is4() {
+		bits = p.IPv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return l, fmt.Errorf("%w: %w", errBadFromIP, err)
+	}
+	l.FromIP = prefix.Addr().String()
+	return l, nil
+}
+
+// dayKey returns hash key of now's UTC day. Key of the previous day is dropped once the day is over,
+// so records of the previous day arriving later are hashed with the key of the new day.
+func (p *Privacy) dayKey(now time.Time) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if day := now.UTC().Format(time.DateOnly); p.key == nil || p.day != day {
+		p.day, p.key = day, make([]byte, 32)
+		_, _ = rand.Read(p.key) // never fails, crashes the program instead
+	}
+	return p.key
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestNewPrivacy(t *testing.T) {
+	p, err := NewPrivacy("truncate", 24, 48)
+	require.NoError(t, err)
+	assert.Equal(t, &Privacy{IPv4Prefix: 24, IPv6Prefix: 48}, p)
+
+	p, err = NewPrivacy("hash", 0, 0)
+	require.NoError(t, err)
+	assert.True(t, p.hash)
+	assert.Nil(t, p.key, "key made on the first use")
+
+	for _, tt := range []struct {
+		mode       string
+		ipv4, ipv6 int
+	}{{"truncate", 33, 48}, {"truncate", 24, -1}, {"bad", 24, 48}} {
+		_, err = NewPrivacy(tt.mode, tt.ipv4, tt.ipv6)
+		assert.Error(t, err, tt)
+	}
+}
+
+func TestPrivacy_Truncate(t *testing.T) {
+	p, err := NewPrivacy("truncate", 24, 48)
+	require.NoError(t, err)
+	tbl := []struct {
+		ip, res string
+	}{
+		{"192.168.1.77", "192.168.1.0"},
+		{"::ffff:192.168.1.77", "192.168.1.0"},
+		{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+		{"fe80::1%eth0", "fe80::"},
+	}
+	for _, tt := range tbl {
+		l, err := p.anonymize(store.LogRecord{FromIP: tt.ip}, time.Now())
+		require.NoError(t, err, tt.ip)
+		assert.Equal(t, tt.res, l.FromIP, tt.ip)
+	}
+
+	_, err = p.anonymize(store.LogRecord{FromIP: "localhost"}, time.Now())
+	assert.ErrorIs(t, err, errBadFromIP)
+}
+
+func TestPrivacy_Hash(t *testing.T) {
+	p, err := NewPrivacy("hash", 0, 0)
+	require.NoError(t, err)
+	day := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	hash := func(ip string, now time.Time) string {
+		l, err := p.anonymize(store.LogRecord{FromIP: ip, Date: day}, now)
+		require.NoError(t, err)
+		return l.FromIP
+	}
+
+	h := hash("192.168.1.77", day)
+	assert.Len(t, h, 32)
+	assert.NotContains(t, h, "192.168")
+	assert.Equal(t, h, hash("192.168.1.77", day.Add(11*time.Hour)), "same within a day")
+	assert.Equal(t, h, hash("::ffff:192.168.1.77", day), "IPv4-mapped address is the same IP")
+	assert.NotEqual(t, h, hash("192.168.1.78", day))
+	key := p.key
+	assert.NotEqual(t, h, hash("192.168.1.77", day.Add(12*time.Hour)), "key rotated next day")
+	assert.NotEqual(t, key, p.key, "new random key")
+	assert.NotEqual(t, h, hash("192.168.1.77", day), "key of the previous day dropped")
+
+	other, err := NewPrivacy("hash", 0, 0)
+	require.NoError(t, err)
+	l, err := other.anonymize(store.LogRecord{FromIP: "192.168.1.77", Date: day}, day)
+	require.NoError(t, err)
+	assert.NotEqual(t, hash("192.168.1.77", day), l.FromIP, "random key of every instance")
+}
+
+func TestServerInsertPrivacy(t *testing.T) {
+	privacy, err := NewPrivacy("truncate", 24, 48)
+	require.NoError(t, err)
+	aggregator := &store.Aggregator{Listeners: true}
+	srv := &Server{Engine: &goodDB{}, Aggregator: aggregator, Privacy: privacy}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	post := func(url, body string) (int, string) {
+		resp, err := http.Post(ts.URL+url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, string(b)
+	}
+
+	code, body := post("/api/insert", `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, code, body)
+	code, body = post("/api/insert", `{"from_ip":"bad","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "bad from_ip")
+	code, body = post("/api/insert/batch",
+		`{"from_ip":"127.0.0.2","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`+"\n"+
+			`{"from_ip":"bad","file_name":"rt_test.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"accepted":1,"rejected":1`)
+
+	// both addresses truncated to the same network are deduplicated within the minute
+	candles := aggregator.Flush()
+	require.Len(t, candles, 1)
+	assert.Equal(t, 1, candles[0].Nodes["all"].Volume)
+	assert.Equal(t, map[string]int{"bad_from_ip": 2}, srv.metrics.rejected)
+}
@@ -0,0 +1,50 @@
+package web
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// fileSeries contains downloads of a single file by aggregation interval
+type fileSeries struct {
+	File   string                   `json:"file"`
+	Series []seriesPoint            `json:"series"` // downloads from all nodes
+	Nodes  map[string][]seriesPoint `json:"nodes"`  // downloads by node, only for nodes with per-node files
+}
+
+// seriesPoint is number of downloads in the interval started at given time
+type seriesPoint struct {
+	Time  time.Time
+	Count int
+}
+
+// MarshalJSON encodes point as compact [unix_timestamp, count] array
+func (p seriesPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]int64{p.Time.Unix(), int64(p.Count)})
+}
+
+// makeFileSeries collects downloads of the file from aggregated candles, intervals without downloads are skipped
+func makeFileSeries(candles []store.Candle, file string) fileSeries {
+	res := fileSeries{File: file, Series: []seriesPoint{}, Nodes: map[string][]seriesPoint{}}
+	for _, c := range candles {
+		for name, node := range c.Nodes {
+			count := node.Files[file]
+			if count == 0 {
+				continue
+			}
+			if name == "all" {
+				res.Series = append(res.Series, seriesPoint{Time: c.StartMinute, Count: count})
+				continue
+			}
+			res.Nodes[name] = append(res.Nodes[name], seriesPoint{Time: c.StartMinute, Count: count})
+		}
+	}
+	sort.Slice(res.Series, func(i, j int) bool { return res.Series[i].Time.Before(res.Series[j].Time) })
+	for _, points := range res.Nodes {
+		sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestMakeFileSeries(t *testing.T) {
+	candles := []store.Candle{
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 1, "/rtfiles/rt_podcast562.mp3": 1}},
+			"n7.radio-t.com": {Volume: 2, Files: map[string]int{}},
+			"all":            {Volume: 4, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 3, "/rtfiles/rt_podcast562.mp3": 1}},
+		}, StartMinute: time.Unix(120, 0)},
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast562.mp3": 1}},
+			"all":            {Volume: 1, Files: map[string]int{"/rtfiles/rt_podcast562.mp3": 1}},
+		}, StartMinute: time.Unix(60, 0)},
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2}},
+			"all":            {Volume: 2, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2}},
+		}, StartMinute: time.Unix(0, 0)},
+	}
+
+	series := makeFileSeries(candles, "/rtfiles/rt_podcast561.mp3")
+	data, err := json.Marshal(series)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"file":"/rtfiles/rt_podcast561.mp3","series":[[0,2],[120,3]],"nodes":{"n6.radio-t.com":[[0,2],[120,1]]}}`,
+		string(data))
+
+	series = makeFileSeries(candles, "/rtfiles/rt_podcast563.mp3")
+	data, err = json.Marshal(series)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"file":"/rtfiles/rt_podcast563.mp3","series":[],"nodes":{}}`, string(data))
+}
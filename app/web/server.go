@@ -5,10 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -21,17 +21,33 @@ import (
 
 // LogAggregator buffers log records and emits minute candles
 type LogAggregator interface {
-	Store(store.LogRecord) (store.Candle, bool)
+	Store(store.LogRecord) ([]store.Candle, error)
+	FlushBefore(time.Time) []store.Candle
+}
+
+// compactionReporter is implemented by engines which compact stored candles
+type compactionReporter interface {
+	CompactionStatus() (store.CompactionStatus, error)
 }
 
 // Server is a web-server for rlb-stats REST API and UI
 type Server struct {
-	Engine       store.Engine
-	Aggregator   LogAggregator
-	Port         int
-	Version      string
-	address      string // set only in tests
-	webappPrefix string // set only in tests
+	Engine        store.Engine
+	Aggregator    LogAggregator
+	Port          int
+	Version       string
+	FlushInterval time.Duration // how often to check for ended minutes, disabled if zero
+	FlushGrace    time.Duration // how long to wait for records after minute end before flushing it
+	MetricsFiles  int           // max distinct files with separate download counters in metrics
+	InsertAuth    *InsertAuth   // authentication of nodes inserting log records, disabled if nil
+	Privacy       *Privacy      // anonymization of client IPs of inserted log records, disabled if nil
+	Geo           GeoLocator    // location of client IPs of inserted log records, disabled if nil
+	ASN           ASNLocator    // autonomous systems of client IPs of inserted log records, disabled if nil
+	address       string        // set only in tests
+	webappPrefix  string        // set only in tests
+
+	metrics downloadMetrics
+	stream  candleHub
 }
 
 // JSON is a map alias, just for convenience
@@ -47,6 +63,7 @@ func (s *Server) Run(ctx context.Context) {
 		ReadTimeout:       5 * time.Minute,
 		WriteTimeout:      5 * time.Minute,
 	}
+	srv.RegisterOnShutdown(s.stream.close)
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -54,7 +71,16 @@ func (s *Server) Run(ctx context.Context) {
 		}
 	}()
 
+	flushDone := make(chan struct{})
+	go func() {
+		defer close(flushDone)
+		if s.FlushInterval > 0 {
+			s.flushLoop(ctx)
+		}
+	}()
+
 	<-ctx.Done()
+	<-flushDone
 	log.Printf("[INFO] shutting down http server")
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -64,6 +90,33 @@ func (s *Server) Run(ctx context.Context) {
 	}
 }
 
+// flushLoop periodically saves candles of minutes which ended more than FlushGrace ago,
+// so stored data is up to date even without new records. Returns when ctx is cancelled.
+func (s *Server) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.flushMinutes(now)
+		}
+	}
+}
+
+// flushMinutes saves candles of minutes ended before now minus FlushGrace
+func (s *Server) flushMinutes(now time.Time) {
+	candles := s.Aggregator.FlushBefore(now.Add(-s.FlushGrace).Truncate(time.Minute))
+	if err := s.saveCandles(candles); err != nil {
+		log.Printf("[WARN] failed to save flushed candles, %v", err)
+		return
+	}
+	if len(candles) > 0 {
+		log.Printf("[DEBUG] flushed %d candle(s) by timer", len(candles))
+	}
+}
+
 func (s *Server) routes() http.Handler {
 	r := routegroup.New(http.NewServeMux())
 
@@ -83,14 +136,29 @@ func (s *Server) routes() http.Handler {
 		rUI.HandleFiles("/", http.Dir(filesDir))
 	})
 
+	// streaming routes group, without request logging and throttling as connections are long-lived
+	r.Route(func(rStream *routegroup.Bundle) {
+		rStream.HandleFunc("GET /api/stream", s.getStream)
+	})
+
 	// API routes group
 	debugLogger := logger.New(logger.Log(log.Default()), logger.Prefix("[DEBUG]"))
 	r.Route(func(rAPI *routegroup.Bundle) {
 		rAPI.Use(debugLogger.Handler)
 
+		rAPI.With(rest.Throttle(10)).HandleFunc("GET /metrics", s.getMetrics)
 		rAPI.Mount("/api").Route(func(r *routegroup.Bundle) {
 			r.With(rest.Throttle(10)).HandleFunc("GET /candle", s.getCandle)
-			r.With(rest.Throttle(100)).HandleFunc("POST /insert", s.insert)
+			r.With(rest.Throttle(10)).HandleFunc("GET /summary", s.getSummary)
+			r.With(rest.Throttle(10)).HandleFunc("GET /compare", s.getCompare)
+			r.With(rest.Throttle(10)).HandleFunc("GET /file/{name}/series", s.getFileSeries)
+			r.With(rest.Throttle(10)).HandleFunc("GET /lifecycle", s.getLifecycle)
+			r.With(rest.Throttle(10)).HandleFunc("GET /listeners", s.getListeners)
+			r.With(rest.Throttle(10)).HandleFunc("GET /geo", s.getGeo)
+			r.With(rest.Throttle(10)).HandleFunc("GET /asn", s.getASN)
+			r.With(rest.Throttle(100), s.authInsert).HandleFunc("POST /insert", s.insert)
+			r.With(rest.Throttle(10), s.authInsert).HandleFunc("POST /insert/batch", s.insertBatch)
+			r.With(rest.Throttle(10)).HandleFunc("GET /status", s.getStatus)
 		})
 	})
 
@@ -98,58 +166,416 @@ func (s *Server) routes() http.Handler {
 }
 
 // GET /api/candle?from=2022-04-06T05:06:17.041Z&to=2022-04-06T06:06:17.041Z&max_points=100&files=10
+// GET /api/candle?from=2022-04-06T05:06:17.041Z&node=n6.radio-t.com&file=re:rt_podcast8\d\d&exclude_file=/rtfiles/*.ogg
+// GET /api/candle?from=2022-04-01T00:00:00+03:00&aggregate=1d&tz=Europe/Moscow
+// GET /api/candle?from=2022-04-06T05:06:17.041Z&format=csv
 func (s *Server) getCandle(w http.ResponseWriter, r *http.Request) {
-	from := r.URL.Query().Get("from")
-	if from == "" {
-		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no 'from' field passed"), "no 'from' field passed")
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
 		return
 	}
-	fromTime, err := time.Parse(time.RFC3339, from)
+	filter, ok := parseCandleFilter(w, r)
+	if !ok {
+		return
+	}
+	format, err := exportFormat(r)
 	if err != nil {
-		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'from' field")
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'format' field")
 		return
 	}
-	toTime := time.Now()
-	if to := r.URL.Query().Get("to"); to != "" {
-		t, terr := time.Parse(time.RFC3339, to)
-		if terr != nil {
-			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, terr, "can't parse 'to' field")
-			return
-		}
-		toTime = t
+	if format != "" {
+		s.exportCandles(w, r, format, fromTime, toTime, filter)
+		return
+	}
+	agg, ok := parseAggregation(w, r, fromTime, toTime)
+	if !ok {
+		return
 	}
-	aggDuration := toTime.Sub(fromTime).Truncate(time.Second) / 100
+	limitFiles := r.URL.Query().Get("files") != "" // all files are returned unless limit is set
+	filesLimit, ok := parseFilesLimit(w, r)
+	if !ok {
+		return
+	}
+
+	candles, err := loadAggregated(r.Context(), s.Engine, fromTime, toTime, agg, filter)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	if limitFiles {
+		candles = limitCandleFiles(candles, filesLimit)
+	}
+
+	rest.RenderJSON(w, dropListeners(candles))
+}
+
+// GET /api/file/%2Frtfiles%2Frt_podcast561.mp3/series?from=2022-04-01T00:00:00Z&to=2022-05-01T00:00:00Z&aggregate=1d
+func (s *Server) getFileSeries(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
+		return
+	}
+	agg, ok := parseAggregation(w, r, fromTime, toTime)
+	if !ok {
+		return
+	}
+	filter := candleFilter{include: []fileMatcher{func(f string) bool { return f == name }}}
+	candles, err := loadAggregated(r.Context(), s.Engine, fromTime, toTime, agg, filter)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	rest.RenderJSON(w, makeFileSeries(candles, name))
+}
+
+// GET /api/lifecycle?file=rt_podcast561.mp3&file=rt_podcast562.mp3@2022-04-01T10:00:00Z&aggregate=1d&span=30d
+func (s *Server) getLifecycle(w http.ResponseWriter, r *http.Request) {
+	files := r.URL.Query()["file"]
+	if len(files) == 0 {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no 'file' field passed"), "no 'file' field passed")
+		return
+	}
+	interval, span := 24*time.Hour, 30*24*time.Hour
+	var err error
 	if a := r.URL.Query().Get("aggregate"); a != "" {
-		aggDuration, err = time.ParseDuration(a)
+		if interval, err = parseDays(a); err == nil && interval < time.Minute {
+			err = errors.New("interval is less than a minute")
+		}
 		if err != nil {
 			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'aggregate' field")
 			return
 		}
+		interval = interval.Truncate(time.Minute)
 	}
-	if n := r.URL.Query().Get("max_points"); n != "" {
-		i, err := strconv.ParseInt(n, 10, 8)
+	sp := r.URL.Query().Get("span")
+	if sp != "" {
+		if span, err = parseDays(sp); err == nil && span <= 0 {
+			err = errors.New("span should be positive")
+		}
 		if err != nil {
-			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'max_points' field")
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'span' field")
 			return
 		}
-		aggDuration = toTime.Sub(fromTime).Truncate(time.Second) / time.Duration(i)
 	}
+	if span/interval > maxLifecyclePoints {
+		// default span is limited by interval as well, blame the field which was passed
+		field := "aggregate"
+		if sp != "" {
+			field = "span"
+		}
+		err = fmt.Errorf("span should not be longer than %d intervals", maxLifecyclePoints)
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, fmt.Sprintf("can't parse '%s' field", field))
+		return
+	}
+
+	now := time.Now()
+	requests := make([]lifecycleRequest, 0, len(files))
+	var toDetect []string
+	for _, f := range files {
+		req := parseLifecycleRequest(f)
+		if req.firstSeen.IsZero() {
+			toDetect = append(toDetect, req.file)
+		}
+		requests = append(requests, req)
+	}
+	detected, err := detectFirstSeen(r.Context(), s.Engine, toDetect, now)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't detect first seen time")
+		return
+	}
+
+	res := []lifecycle{}
+	missing := []string{}
+	for _, req := range requests {
+		item := lifecycle{File: req.file, FirstSeen: req.firstSeen}
+		if item.FirstSeen.IsZero() {
+			t, ok := detected[req.file]
+			if !ok {
+				missing = append(missing, req.file)
+				continue
+			}
+			item.FirstSeen, item.Detected = t, true
+		}
+		if item.Curve, err = loadLifecycle(r.Context(), s.Engine, req.file, item.FirstSeen, interval, span, now); err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+			return
+		}
+		res = append(res, item)
+	}
+	rest.RenderJSON(w, JSON{"interval": int64(interval / time.Second), "files": res, "missing": missing})
+}
 
-	candles, err := loadCandles(r.Context(), s.Engine, fromTime, toTime, aggDuration)
+// GET /api/compare?from=2022-04-08T00:00:00Z&to=2022-04-15T00:00:00Z&offset=7d&aggregate=1d&files=10
+func (s *Server) getCompare(w http.ResponseWriter, r *http.Request) {
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
+		return
+	}
+	agg, ok := parseAggregation(w, r, fromTime, toTime)
+	if !ok {
+		return
+	}
+	offset, err := parseCompareOffset(r.URL.Query().Get("offset"), agg)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'offset' field")
+		return
+	}
+	filter, ok := parseCandleFilter(w, r)
+	if !ok {
+		return
+	}
+	filesLimit, ok := parseFilesLimit(w, r)
+	if !ok {
+		return
+	}
+
+	current, err := loadAggregated(r.Context(), s.Engine, fromTime, toTime, agg, filter)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	previous, err := loadAggregated(r.Context(), s.Engine, offset.back(fromTime), offset.back(toTime), agg, filter)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	res := compareCandles(current, previous, offset, filesLimit)
+	res.From, res.To = fromTime, toTime
+	rest.RenderJSON(w, res)
+}
+
+// exportCandles streams candles as CSV or NDJSON rows, called from getCandle
+func (s *Server) exportCandles(w http.ResponseWriter, r *http.Request, format string, from, to time.Time, filter candleFilter) {
+	resolution, err := exportResolution(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'aggregate' field")
+		return
+	}
+	started, err := exportCandles(r.Context(), w, s.Engine, format, from, to, resolution, filter)
+	if err != nil && !started {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	if err != nil {
+		log.Printf("[WARN] export interrupted, %v", err)
+	}
+}
+
+// GET /api/summary?from=2022-04-01T00:00:00Z&to=2022-04-08T00:00:00Z&files=10
+func (s *Server) getSummary(w http.ResponseWriter, r *http.Request) {
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
+		return
+	}
+	filesLimit, ok := parseFilesLimit(w, r)
+	if !ok {
+		return
+	}
+	res, err := loadSummary(r.Context(), s.Engine, fromTime, toTime, filesLimit)
 	if err != nil {
 		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
 		return
 	}
-	if files := r.URL.Query().Get("files"); files != "" {
-		filesN, err := strconv.Atoi(files)
+	rest.RenderJSON(w, res)
+}
+
+// GET /api/geo?from=2022-04-01T00:00:00Z&to=2022-05-01T00:00:00Z
+func (s *Server) getGeo(w http.ResponseWriter, r *http.Request) {
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
+		return
+	}
+	res, err := loadGeo(r.Context(), s.Engine, fromTime, toTime)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	rest.RenderJSON(w, res)
+}
+
+// GET /api/asn?from=2022-04-01T00:00:00Z&to=2022-05-01T00:00:00Z&asns=10
+func (s *Server) getASN(w http.ResponseWriter, r *http.Request) {
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := parseTopLimit(w, r, "asns")
+	if !ok {
+		return
+	}
+	res, err := loadASNs(r.Context(), s.Engine, fromTime, toTime, limit)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	rest.RenderJSON(w, res)
+}
+
+// GET /api/listeners?from=2022-04-01T00:00:00Z&to=2022-05-01T00:00:00Z&aggregate=1d&files=10
+func (s *Server) getListeners(w http.ResponseWriter, r *http.Request) {
+	fromTime, toTime, ok := parsePeriod(w, r)
+	if !ok {
+		return
+	}
+	agg, ok := parseAggregation(w, r, fromTime, toTime)
+	if !ok {
+		return
+	}
+	filter, ok := parseCandleFilter(w, r)
+	if !ok {
+		return
+	}
+	filesLimit, ok := parseFilesLimit(w, r)
+	if !ok {
+		return
+	}
+	candles, err := loadAggregated(r.Context(), s.Engine, fromTime, toTime, agg, filter)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't load candles")
+		return
+	}
+	res := countListeners(candles, filesLimit)
+	res.From, res.To = fromTime, toTime
+	rest.RenderJSON(w, res)
+}
+
+// GET /api/status
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := s.Engine.(compactionReporter)
+	if !ok {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusNotImplemented, errors.New("no compaction status"),
+			"storage doesn't report compaction status")
+		return
+	}
+	status, err := reporter.CompactionStatus()
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't get compaction status")
+		return
+	}
+	rest.RenderJSON(w, JSON{"compaction": status})
+}
+
+// authInsert authenticates insert requests with InsertAuth if it's set, and passes authenticated node
+// in request context to check it against dest of inserted records
+func (s *Server) authInsert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.InsertAuth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		node, err := s.InsertAuth.authenticate(r, time.Now())
 		if err != nil {
-			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'files' field")
+			s.metrics.reject("unauthorized")
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusUnauthorized, err, "Unauthorized")
 			return
 		}
-		candles = limitCandleFiles(candles, filesN)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nodeKey{}, node)))
+	})
+}
+
+// GET /metrics
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{w: w}
+	s.metrics.writeTo(mw)
+	if reporter, ok := s.Aggregator.(bufferReporter); ok {
+		minutes, keys := reporter.BufferSize()
+		mw.header("rlb_stats_aggregator_open_minutes", "gauge", "Minutes buffered by aggregator.")
+		mw.value("rlb_stats_aggregator_open_minutes", int64(minutes))
+		mw.header("rlb_stats_aggregator_keys", "gauge", "Deduplication keys buffered by aggregator.")
+		mw.value("rlb_stats_aggregator_keys", int64(keys))
+	}
+	if reporter, ok := s.Engine.(storageReporter); ok {
+		stats, err := reporter.StorageStats()
+		if err != nil {
+			log.Printf("[WARN] can't get storage stats for metrics, %v", err)
+		}
+		if err == nil {
+			mw.header("rlb_stats_storage_size_bytes", "gauge", "Size of the storage file.")
+			mw.value("rlb_stats_storage_size_bytes", stats.Size)
+			mw.header("rlb_stats_storage_candles", "gauge", "Stored candles by resolution.")
+			mw.labeled("rlb_stats_storage_candles", "resolution", stats.Candles)
+		}
+	}
+	if mw.err != nil {
+		log.Printf("[WARN] can't write metrics, %v", mw.err)
 	}
+}
+
+// GET /api/stream?partial=5s&node=n6.radio-t.com&file=re:rt_podcast8\d\d
+func (s *Server) getStream(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseCandleFilter(w, r)
+	if !ok {
+		return
+	}
+	var partial time.Duration
+	if p := r.URL.Query().Get("partial"); p != "" {
+		var err error
+		if partial, err = time.ParseDuration(p); err == nil && partial < time.Second {
+			err = errors.New("partial interval is less than a second")
+		}
+		if err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse 'partial' field")
+			return
+		}
+	}
+	candles, ok := s.stream.subscribe()
+	if !ok {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusServiceUnavailable, errors.New("stream is not available"),
+			"too many stream clients")
+		return
+	}
+	defer s.stream.unsubscribe(candles)
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("[DEBUG] can't disable write deadline for stream, %v", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
 
-	rest.RenderJSON(w, candles)
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	var partialTicks <-chan time.Time // nil channel never fires, partial candles disabled
+	pending, hasPending := s.Aggregator.(pendingReporter)
+	if hasPending && partial > 0 {
+		ticker := time.NewTicker(partial)
+		defer ticker.Stop()
+		partialTicks = ticker.C
+	}
+
+	for {
+		err := rc.Flush()
+		if err == nil {
+			select {
+			case <-r.Context().Done():
+				return
+			case c, ok := <-candles:
+				if !ok {
+					return // disconnected by hub
+				}
+				if c, ok = filter.applyCandle(c); ok {
+					c.Listeners = nil
+					err = writeEvent(w, "candle", c)
+				}
+			case <-partialTicks:
+				for _, c := range dropListeners(filter.apply(pending.Pending())) {
+					if err = writeEvent(w, "partial", c); err != nil {
+						break
+					}
+				}
+			case <-keepAlive.C:
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+			}
+		}
+		if err != nil {
+			log.Printf("[DEBUG] stream closed, %v", err)
+			return
+		}
+	}
 }
 
 // POST /api/insert
@@ -158,30 +584,102 @@ func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
 	var l store.LogRecord
 	err := decoder.Decode(&l)
 	if err != nil {
+		s.metrics.reject("bad_json")
 		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "Problem decoding JSON")
 		return
 	}
-	if l.Date.Equal(time.Time{}) {
-		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("missing field in JSON"), "missing field in JSON: ts")
+	if err = validateLogRecord(l); err != nil {
+		s.metrics.reject(rejectReason(err))
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+	if err = checkDest(r.Context(), l); err != nil {
+		s.metrics.reject(rejectReason(err))
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusForbidden, err, err.Error())
 		return
 	}
-	if l.DestHost == "" {
-		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("missing field in JSON"), "missing field in JSON: dest")
+	if l, err = s.anonymize(s.locate(l)); err != nil {
+		s.metrics.reject(rejectReason(err))
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
 		return
 	}
-	if l.FileName == "" {
-		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("missing field in JSON"), "missing field in JSON: file_name")
+	err = s.saveLogRecord(l)
+	if err != nil {
+		s.metrics.reject(rejectReason(err))
+	}
+	if errors.Is(err, store.ErrTooLate) {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "LogRecord is too late")
 		return
 	}
-	if l.FromIP == "" {
-		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("missing field in JSON"), "missing field in JSON: from_ip")
+	if errors.Is(err, store.ErrTooEarly) {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "LogRecord is from the future")
 		return
 	}
-	err = saveLogRecord(s.Engine, s.Aggregator, l)
 	if err != nil {
 		rest.SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "Problem saving LogRecord")
 		return
 	}
 
+	s.metrics.accept()
 	rest.RenderJSON(w, rest.JSON{"result": "ok"})
 }
+
+// POST /api/insert/batch, body is either JSON array of LogRecords or newline-delimited JSON stream of them
+func (s *Server) insertBatch(w http.ResponseWriter, r *http.Request) {
+	result := batchResult{Results: []batchLineResult{}}
+	err := decodeLogRecords(r.Body, func(line int, l store.LogRecord, decodeErr error) {
+		if decodeErr != nil {
+			s.metrics.reject("bad_json")
+			result.add(line, "Problem decoding JSON")
+			return
+		}
+		if err := validateLogRecord(l); err != nil {
+			s.metrics.reject(rejectReason(err))
+			result.add(line, err.Error())
+			return
+		}
+		if err := checkDest(r.Context(), l); err != nil {
+			s.metrics.reject(rejectReason(err))
+			result.add(line, err.Error())
+			return
+		}
+		l, err := s.anonymize(s.locate(l))
+		if err != nil {
+			s.metrics.reject(rejectReason(err))
+			result.add(line, err.Error())
+			return
+		}
+		err = s.saveLogRecord(l)
+		if err != nil {
+			s.metrics.reject(rejectReason(err))
+		}
+		if errors.Is(err, store.ErrTooLate) {
+			result.add(line, "LogRecord is too late")
+			return
+		}
+		if errors.Is(err, store.ErrTooEarly) {
+			result.add(line, "LogRecord is from the future")
+			return
+		}
+		if err != nil {
+			log.Printf("[WARN] failed to save LogRecord from line %d, %v", line, err)
+			result.add(line, "Problem saving LogRecord")
+			return
+		}
+		s.metrics.accept()
+		result.add(line, "")
+	})
+	var cut *batchCutError
+	if errors.As(err, &cut) {
+		// records before the cut are already saved, so they are reported instead of failing the whole batch
+		log.Printf("[WARN] %v", err)
+		result.Error = fmt.Sprintf("Problem reading batch at line %d, the rest is not processed", cut.line)
+		err = nil
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "Problem reading batch")
+		return
+	}
+
+	rest.RenderJSON(w, result)
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -77,12 +79,125 @@ func TestServerAPI(t *testing.T) {
 			result: "{\"error\":\"can't parse 'max_points' field\"}\n"},
 		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&to=%v", startTime, startTime), responseCode: http.StatusOK,
 			result: "[]\n"},
-		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v", startTime), responseCode: http.StatusOK,
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v", url.QueryEscape(endTime)), responseCode: http.StatusOK,
 			candles: []store.Candle{storedCandle}},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&aggregate=5m", url.QueryEscape(time.Unix(-2*60, 0).Format(time.RFC3339))),
+			responseCode: http.StatusOK, candles: []store.Candle{{Nodes: storedCandle.Nodes, StartMinute: time.Unix(-2*60, 0)}}},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&aggregate=1d&tz=Europe/Moscow", url.QueryEscape(endTime)),
+			responseCode: http.StatusOK, result: `[{"Nodes":{"all":{"Volume":1,"Files":{"/rtfiles/rt_podcast561.mp3":1}},` +
+				`"n6.radio-t.com":{"Volume":1,"Files":{"/rtfiles/rt_podcast561.mp3":1}}},"StartMinute":"1970-01-01T00:00:00+03:00"}]` + "\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&aggregate=0mo", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'aggregate' field\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&aggregate=1w&tz=Mars/Olympus", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'tz' field\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&node=n6.radio-t.com", url.QueryEscape(endTime)), responseCode: http.StatusOK,
+			candles: []store.Candle{{Nodes: map[string]store.Info{"n6.radio-t.com": storedCandle.Nodes["n6.radio-t.com"]},
+				StartMinute: storedCandle.StartMinute}}},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&node=n7.radio-t.com", url.QueryEscape(endTime)), responseCode: http.StatusOK,
+			result: "[]\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&node=all&file=/rtfiles/*.mp3", url.QueryEscape(endTime)),
+			responseCode: http.StatusOK, candles: []store.Candle{{Nodes: map[string]store.Info{"all": storedCandle.Nodes["all"]},
+				StartMinute: storedCandle.StartMinute}}},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&exclude_file=re:561", url.QueryEscape(endTime)), responseCode: http.StatusOK,
+			result: "[]\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&file=re:(", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'file' field\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&exclude_file=[", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'exclude_file' field\"}\n"},
 		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&files=bad", startTime), responseCode: http.StatusBadRequest,
 			result: "{\"error\":\"can't parse 'files' field\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&files=-1", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'files' field\"}\n"},
 		{ts: badServer, url: fmt.Sprintf("/api/candle?from=%v&to=%v&aggregate=5m&max_points=10", startTime, url.QueryEscape(endTime)), responseCode: http.StatusBadRequest,
 			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/summary", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"no 'from' field passed\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/summary?from=%v&files=-1", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'files' field\"}\n"},
+		{ts: goodServer, url: "/api/summary?from=1970-01-01T00:00:00Z&to=1970-01-02T00:00:00Z", responseCode: http.StatusOK,
+			result: `{"from":"1970-01-01T00:00:00Z","to":"1970-01-02T00:00:00Z","volume":1,"nodes":{"n6.radio-t.com":1},` +
+				`"files":[{"name":"/rtfiles/rt_podcast561.mp3","count":1,"percent":100}],"distinct_nodes":1,"distinct_files":1}` + "\n"},
+		{ts: badServer, url: fmt.Sprintf("/api/summary?from=%v", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/file/%2Frtfiles%2Frt_podcast561.mp3/series?from=1970-01-01T00:00:00Z&aggregate=1d",
+			responseCode: http.StatusOK,
+			result:       `{"file":"/rtfiles/rt_podcast561.mp3","series":[[0,1]],"nodes":{"n6.radio-t.com":[[0,1]]}}` + "\n"},
+		{ts: goodServer, url: "/api/file/rt_podcast561.mp3/series?from=1970-01-01T00:00:00Z", responseCode: http.StatusOK,
+			result: `{"file":"rt_podcast561.mp3","series":[],"nodes":{}}` + "\n"},
+		{ts: goodServer, url: "/api/file/rt_podcast561.mp3/series?from=1970-01-01T00:00:00Z&aggregate=bad",
+			responseCode: http.StatusBadRequest, result: "{\"error\":\"can't parse 'aggregate' field\"}\n"},
+		{ts: goodServer, url: "/api/file/rt_podcast561.mp3/series", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"no 'from' field passed\"}\n"},
+		{ts: badServer, url: "/api/file/rt_podcast561.mp3/series?from=1970-01-01T00:00:00Z", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/lifecycle?file=/rtfiles/rt_podcast561.mp3&file=/rtfiles/rt_podcast562.mp3&aggregate=1h&span=2h",
+			responseCode: http.StatusOK, result: `{"files":[{"file":"/rtfiles/rt_podcast561.mp3","first_seen":"` + endTime + `",` +
+				`"detected":true,"curve":[1,1]}],"interval":3600,"missing":["/rtfiles/rt_podcast562.mp3"]}` + "\n"},
+		{ts: goodServer, url: "/api/lifecycle?file=/rtfiles/rt_podcast561.mp3@1969-12-31T23:00:00Z&span=2d",
+			responseCode: http.StatusOK, result: `{"files":[{"file":"/rtfiles/rt_podcast561.mp3","first_seen":"1969-12-31T23:00:00Z",` +
+				`"detected":false,"curve":[1,1]}],"interval":86400,"missing":[]}` + "\n"},
+		{ts: goodServer, url: "/api/lifecycle", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"no 'file' field passed\"}\n"},
+		{ts: goodServer, url: "/api/lifecycle?file=a.mp3&aggregate=1s", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'aggregate' field\"}\n"},
+		{ts: goodServer, url: "/api/lifecycle?file=a.mp3&aggregate=1h&span=365d", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'span' field\"}\n"},
+		{ts: goodServer, url: "/api/lifecycle?file=a.mp3&aggregate=1m", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'aggregate' field\"}\n"},
+		{ts: goodServer, url: "/api/lifecycle?file=a.mp3&span=-1d", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'span' field\"}\n"},
+		{ts: badServer, url: "/api/lifecycle?file=a.mp3", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't detect first seen time\"}\n"},
+		{ts: badServer, url: "/api/lifecycle?file=a.mp3@2024-01-01T00:00:00Z", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/compare?from=1970-01-08T00:00:00Z&to=1970-01-09T00:00:00Z&offset=7d&aggregate=1d&node=all",
+			responseCode: http.StatusOK, result: `{"from":"1970-01-08T00:00:00Z","to":"1970-01-09T00:00:00Z","offset":"7d",` +
+				`"buckets":[{"start":"1970-01-08T00:00:00Z","current":0,"previous":1,"delta":-1,"percent":-100}],` +
+				`"nodes":{"all":{"current":0,"previous":1,"delta":-1,"percent":-100}},"files":[]}` + "\n"},
+		{ts: goodServer, url: "/api/compare?from=1970-01-08T00:00:00Z&offset=-1d", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'offset' field\"}\n"},
+		{ts: goodServer, url: "/api/compare?from=1970-01-08T00:00:00Z&offset=90m&aggregate=1h", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'offset' field\"}\n"},
+		{ts: goodServer, url: "/api/compare?from=1970-01-08T00:00:00Z&files=x", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'files' field\"}\n"},
+		{ts: goodServer, url: "/api/compare?from=1970-01-08T00:00:00Z&file=re:(", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'file' field\"}\n"},
+		{ts: badServer, url: "/api/compare?from=1970-01-08T00:00:00Z", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%[1]s&to=%[1]s&format=csv", url.QueryEscape(endTime)), responseCode: http.StatusOK,
+			result: fmt.Sprintf("minute,node,file,count\n%[1]s,all,,1\n%[1]s,all,/rtfiles/rt_podcast561.mp3,1\n"+
+				"%[1]s,n6.radio-t.com,,1\n%[1]s,n6.radio-t.com,/rtfiles/rt_podcast561.mp3,1\n", endTime)},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%[1]s&to=%[1]s&format=ndjson&node=n6.radio-t.com&aggregate=1h", url.QueryEscape(endTime)),
+			responseCode: http.StatusOK, result: fmt.Sprintf(`{"minute":%[1]q,"node":"n6.radio-t.com","file":"","count":1}`+"\n"+
+				`{"minute":%[1]q,"node":"n6.radio-t.com","file":"/rtfiles/rt_podcast561.mp3","count":1}`+"\n", endTime)},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&format=xml", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'format' field\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&format=csv&aggregate=5m", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'aggregate' field\"}\n"},
+		{ts: badServer, url: fmt.Sprintf("/api/candle?from=%v&format=csv", startTime), responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/listeners?from=1970-01-01T00:00:00Z&to=1970-01-02T00:00:00Z&aggregate=1d",
+			responseCode: http.StatusOK, result: `{"from":"1970-01-01T00:00:00Z","to":"1970-01-02T00:00:00Z",` +
+				`"nodes":{},"files":[],"buckets":[]}` + "\n"},
+		{ts: badServer, url: "/api/listeners?from=1970-01-01T00:00:00Z", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/geo?from=1970-01-01T00:00:00Z&to=1970-01-02T00:00:00Z", responseCode: http.StatusOK,
+			result: `{"from":"1970-01-01T00:00:00Z","to":"1970-01-02T00:00:00Z","volume":0,"countries":[],"regions":[]}` + "\n"},
+		{ts: badServer, url: "/api/geo?from=1970-01-01T00:00:00Z", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: "/api/asn?from=1970-01-01T00:00:00Z&to=1970-01-02T00:00:00Z&asns=5", responseCode: http.StatusOK,
+			result: `{"from":"1970-01-01T00:00:00Z","to":"1970-01-02T00:00:00Z","volume":0,"asns":[]}` + "\n"},
+		{ts: goodServer, url: "/api/asn?from=1970-01-01T00:00:00Z&asns=-1", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't parse 'asns' field\"}\n"},
+		{ts: badServer, url: "/api/asn?from=1970-01-01T00:00:00Z", responseCode: http.StatusBadRequest,
+			result: "{\"error\":\"can't load candles\"}\n"},
+		{ts: goodServer, url: fmt.Sprintf("/api/candle?from=%v&country=us&file=rt_podcast561.mp3", startTime),
+			responseCode: http.StatusBadRequest, result: "{\"error\":\"can't parse 'country' field\"}\n"},
+		{ts: goodServer, url: "/api/status", responseCode: http.StatusOK,
+			result: `{"compaction":{"last_run":"0001-01-01T00:00:00Z","runs":0,"minutes_removed":0,"hours_removed":0,` +
+				`"days_removed":0,"candles":{"day":1,"hour":1,"minute":1}}}` + "\n"},
+		{ts: badServer, url: "/api/status", responseCode: http.StatusNotImplemented,
+			result: "{\"error\":\"storage doesn't report compaction status\"}\n"},
 		{ts: goodServer, url: "/api/insert", responseCode: http.StatusBadRequest, method: http.MethodPost,
 			result: "{\"error\":\"Problem decoding JSON\"}\n"},
 		{ts: goodServer, url: "/api/insert", responseCode: http.StatusBadRequest, method: http.MethodPost,
@@ -100,8 +215,14 @@ func TestServerAPI(t *testing.T) {
 		{ts: badServer, url: "/api/insert", responseCode: http.StatusOK, method: http.MethodPost,
 			body:   bytes.NewReader([]byte(`{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"new_node","ts":"1970-01-01T01:01:00+01:00"}`)),
 			result: "{\"result\":\"ok\"}\n"},
-		{ts: badServer, url: "/api/insert", responseCode: http.StatusInternalServerError, method: http.MethodPost,
+		{ts: badServer, url: "/api/insert", responseCode: http.StatusBadRequest, method: http.MethodPost,
 			body:   bytes.NewReader([]byte(`{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"new_node","ts":"1970-01-01T01:00:00+01:00"}`)),
+			result: "{\"error\":\"LogRecord is too late\"}\n"},
+		{ts: badServer, url: "/api/insert", responseCode: http.StatusBadRequest, method: http.MethodPost,
+			body:   bytes.NewReader([]byte(`{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"new_node","ts":"2999-01-01T00:00:00Z"}`)),
+			result: "{\"error\":\"LogRecord is from the future\"}\n"},
+		{ts: badServer, url: "/api/insert", responseCode: http.StatusInternalServerError, method: http.MethodPost,
+			body:   bytes.NewReader([]byte(`{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"new_node","ts":"1970-01-01T01:02:00+01:00"}`)),
 			result: "{\"error\":\"Problem saving LogRecord\"}\n"},
 	}
 	client := http.Client{}
@@ -133,6 +254,167 @@ func TestServerAPI(t *testing.T) {
 	}
 }
 
+func TestServerInsertBatch(t *testing.T) {
+	ts, teardown := startupT(t, false)
+	defer teardown()
+
+	tbl := []struct {
+		name   string
+		body   string
+		code   int
+		result string
+	}{
+		{name: "json array", code: http.StatusOK,
+			body: `[{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n1","ts":"2024-01-01T12:00:00Z"},
+				{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","ts":"2024-01-01T12:00:00Z"},
+				{"from_ip":"127.0.0.2","file_name":"rt_test.mp3","dest":"n1","ts":"2024-01-01T12:01:00Z"}]`,
+			result: `{"accepted":2,"rejected":1,"results":[{"line":1,"result":"ok"},` +
+				`{"line":2,"error":"missing field in JSON: dest"},{"line":3,"result":"ok"}]}` + "\n"},
+		{name: "ndjson", code: http.StatusOK,
+			body: `{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n1","ts":"2024-01-01T12:02:00Z"}` + "\n" +
+				`{bad json}` + "\n" +
+				`{"from_ip":"127.0.0.1","file_name":"rt_test.mp3","dest":"n2","ts":"2024-01-01T12:03:00Z"}`,
+			result: `{"accepted":2,"rejected":1,"results":[{"line":1,"result":"ok"},` +
+				`{"line":2,"error":"Problem decoding JSON"},{"line":3,"result":"ok"}]}` + "\n"},
+		{name: "empty body", code: http.StatusOK, body: "",
+			result: `{"accepted":0,"rejected":0,"results":[]}` + "\n"},
+		{name: "line too long", code: http.StatusOK,
+			body: `{"from_ip":"127.0.0.3","file_name":"rt_test.mp3","dest":"n3","ts":"2024-01-01T12:04:00Z"}` + "\n" +
+				strings.Repeat("x", maxBatchLineSize+1) + "\n" +
+				`{"from_ip":"127.0.0.3","file_name":"rt_test.mp3","dest":"n3","ts":"2024-01-01T12:04:00Z"}`,
+			result: `{"accepted":1,"rejected":1,"results":[{"line":1,"result":"ok"},{"line":2,"error":"Problem decoding JSON"}],` +
+				`"error":"Problem reading batch at line 2, the rest is not processed"}` + "\n"},
+		{name: "array cut by syntax error", code: http.StatusOK,
+			body: `[{"from_ip":"127.0.0.4","file_name":"rt_test.mp3","dest":"n3","ts":"2024-01-01T12:04:00Z"}, {"from_ip":}, {}]`,
+			result: `{"accepted":1,"rejected":1,"results":[{"line":1,"result":"ok"},{"line":2,"error":"Problem decoding JSON"}],` +
+				`"error":"Problem reading batch at line 2, the rest is not processed"}` + "\n"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/api/insert/batch", "application/json", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode, string(body))
+			assert.Equal(t, tt.result, string(body))
+		})
+	}
+
+	// records from first four minutes are saved as the later minutes arrived
+	resp, err := http.Get(ts.URL + "/api/candle?from=2024-01-01T12:00:00Z&to=2024-01-01T12:05:00Z&aggregate=1m")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var candles []store.Candle
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&candles))
+	require.Len(t, candles, 4)
+	assert.Equal(t, 1, candles[0].Nodes["n1"].Volume)
+	assert.Equal(t, 1, candles[1].Nodes["n1"].Volume)
+	assert.Equal(t, 1, candles[2].Nodes["n1"].Volume)
+	assert.Equal(t, 1, candles[3].Nodes["n2"].Volume)
+}
+
+func TestServerMetrics(t *testing.T) {
+	storage, engineTeardown := startupEngine(t, false)
+	defer engineTeardown()
+	srv := &Server{Engine: storage, Aggregator: &store.Aggregator{}, MetricsFiles: 1}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, body := range []string{
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","dest":"n6","ts":"2024-01-01T12:00:00Z"}`,
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast562.mp3","dest":"n7","ts":"2024-01-01T12:00:00Z"}`,
+		`{"from_ip":"127.0.0.2","file_name":"rt_podcast562.mp3","dest":"n7","ts":"2024-01-01T12:00:00Z"}`,
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","dest":"n6","ts":"2024-01-01T12:01:00Z"}`,
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","ts":"2024-01-01T12:01:00Z"}`,
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","dest":"n6","ts":"2024-01-01T11:00:00Z"}`,
+		`{bad json}`,
+	} {
+		resp, err := http.Post(ts.URL+"/api/insert", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// only the first minute is saved, files over the limit are counted as "other"
+	expected := `# HELP rlb_stats_node_downloads_total Downloads by node.
+# TYPE rlb_stats_node_downloads_total counter
+rlb_stats_node_downloads_total{node="n6"} 1
+rlb_stats_node_downloads_total{node="n7"} 2
+# HELP rlb_stats_file_downloads_total Downloads by file, files over the limit are counted as "other".
+# TYPE rlb_stats_file_downloads_total counter
+rlb_stats_file_downloads_total{file="other"} 2
+rlb_stats_file_downloads_total{file="rt_podcast561.mp3"} 1
+`
+	assert.True(t, strings.HasPrefix(string(body), expected), string(body))
+	assert.Contains(t, string(body), `# TYPE rlb_stats_records_accepted_total counter
+rlb_stats_records_accepted_total 4
+# HELP rlb_stats_records_rejected_total Log records rejected by insert, by reason.
+# TYPE rlb_stats_records_rejected_total counter
+rlb_stats_records_rejected_total{reason="bad_json"} 1
+rlb_stats_records_rejected_total{reason="missing_dest"} 1
+rlb_stats_records_rejected_total{reason="too_late"} 1
+`)
+	assert.Contains(t, string(body), "rlb_stats_aggregator_open_minutes 1\n")
+	assert.Contains(t, string(body), "rlb_stats_aggregator_keys 1\n")
+	assert.Contains(t, string(body), `rlb_stats_storage_candles{resolution="day"} 2
+rlb_stats_storage_candles{resolution="hour"} 2
+rlb_stats_storage_candles{resolution="minute"} 2
+`, "candle stored on startup and the first minute")
+	assert.Regexp(t, `rlb_stats_storage_size_bytes \d+\n`, string(body))
+}
+
+func TestServerInsertConcurrent(t *testing.T) {
+	const workers, records = 20, 50
+	ts, teardown := startupT(t, false)
+	defer teardown()
+	baseTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	post := func(ip string, date time.Time) error {
+		body := fmt.Sprintf(`{"from_ip":%q,"file_name":"rt_test.mp3","dest":"n1","ts":%q}`, ip, date.Format(time.RFC3339))
+		resp, err := http.Post(ts.URL+"/api/insert", "application/json", strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range records {
+				assert.NoError(t, post(fmt.Sprintf("10.0.%d.%d", w, i), baseTime.Add(time.Duration(i)*time.Second)))
+			}
+		}()
+	}
+	wg.Wait()
+	// record from the next minute dumps the first one into storage
+	require.NoError(t, post("127.0.0.1", baseTime.Add(time.Minute)))
+
+	resp, err := http.Get(ts.URL + "/api/candle?from=2024-01-01T12:00:00Z&to=2024-01-01T12:05:00Z&aggregate=1m")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var candles []store.Candle
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&candles))
+	require.Len(t, candles, 1)
+	assert.Equal(t, workers*records, candles[0].Nodes["n1"].Volume)
+	assert.Equal(t, workers*records, candles[0].Nodes["all"].Files["rt_test.mp3"])
+}
+
 func TestServerRunShutdown(t *testing.T) {
 	storage, teardown := startupEngine(t, false)
 	defer teardown()
@@ -167,6 +449,53 @@ func TestServerRunShutdown(t *testing.T) {
 	}
 }
 
+func TestServerFlushLoop(t *testing.T) {
+	storage, teardown := startupEngine(t, false)
+	defer teardown()
+
+	aggregator := &store.Aggregator{Window: time.Hour}
+	srv := &Server{
+		address:       "127.0.0.1",
+		Engine:        storage,
+		Aggregator:    aggregator,
+		Version:       "test",
+		FlushInterval: 10 * time.Millisecond,
+		FlushGrace:    time.Minute,
+	}
+
+	// minute ended long ago and current minute which is still in progress
+	prevMinute := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	for _, ts := range []time.Time{prevMinute, time.Now()} {
+		_, err := aggregator.Store(store.LogRecord{FromIP: "127.0.0.1", FileName: "rt_test.mp3", DestHost: "n1", Date: ts})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		candles, err := storage.Load(context.Background(), prevMinute, prevMinute)
+		return err == nil && len(candles) == 1 && candles[0].Nodes["n1"].Volume == 1
+	}, time.Second, 10*time.Millisecond, "ended minute flushed by timer")
+
+	cancel()
+	<-done
+
+	candles, err := storage.Load(context.Background(), prevMinute.Add(time.Minute), time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, candles, "current minute is not flushed")
+	assert.Len(t, aggregator.Flush(), 1, "current minute is still buffered")
+}
+
+func TestServerFlushMinutesError(t *testing.T) {
+	srv := &Server{Engine: MockDB{}, Aggregator: &mockAggregator{candles: []store.Candle{storedCandle}}}
+	srv.flushMinutes(time.Now()) // logs error, must not panic
+}
+
 func startupT(t *testing.T, badEngine bool) (ts *httptest.Server, teardown func()) {
 	storage, engineTeardown := startupEngine(t, badEngine)
 
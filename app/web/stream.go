@@ -0,0 +1,97 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+const (
+	maxStreamClients = 100              // max concurrent stream connections
+	streamBuffer     = 100              // candles buffered for a stream client, slower clients are disconnected
+	streamKeepAlive  = 30 * time.Second // how often to send comment to keep idle stream connection open
+)
+
+// pendingReporter is implemented by aggregators able to return candles of minutes not emitted yet
+type pendingReporter interface {
+	Pending() []store.Candle
+}
+
+// candleHub broadcasts saved candles to stream clients. Zero value is ready to use.
+type candleHub struct {
+	mu      sync.Mutex
+	clients map[chan store.Candle]struct{}
+	closed  bool // set on server shutdown, no new clients accepted
+}
+
+// subscribe returns channel receiving published candles, which is closed when client is disconnected by hub.
+// Returns false if there are too many clients or hub is closed.
+func (h *candleHub) subscribe() (chan store.Candle, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || len(h.clients) >= maxStreamClients {
+		return nil, false
+	}
+	if h.clients == nil {
+		h.clients = map[chan store.Candle]struct{}{}
+	}
+	ch := make(chan store.Candle, streamBuffer)
+	h.clients[ch] = struct{}{}
+	return ch, true
+}
+
+// unsubscribe removes client, closing its channel unless hub disconnected it already
+func (h *candleHub) unsubscribe(ch chan store.Candle) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[ch]; ok {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// publish sends candles to all clients without blocking, clients with full buffer are disconnected
+func (h *candleHub) publish(candles []store.Candle) {
+	if len(candles) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		for _, c := range candles {
+			select {
+			case ch <- c:
+				continue
+			default:
+			}
+			delete(h.clients, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// close disconnects all clients and rejects new ones
+func (h *candleHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// writeEvent writes server-sent event with JSON encoded data
+func writeEvent(w io.Writer, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestCandleHub(t *testing.T) {
+	h := candleHub{}
+	h.publish([]store.Candle{storedCandle}) // no clients
+
+	fast, ok := h.subscribe()
+	require.True(t, ok)
+	slow, ok := h.subscribe()
+	require.True(t, ok)
+
+	candles := make([]store.Candle, streamBuffer)
+	h.publish(candles)
+	for range streamBuffer {
+		<-fast
+	}
+	h.publish([]store.Candle{storedCandle})
+	assert.Equal(t, storedCandle, <-fast)
+	for range streamBuffer {
+		<-slow
+	}
+	_, open := <-slow
+	assert.False(t, open, "slow client with full buffer disconnected")
+	h.unsubscribe(slow) // already disconnected
+
+	for range maxStreamClients - 1 {
+		_, ok = h.subscribe()
+		require.True(t, ok)
+	}
+	_, ok = h.subscribe()
+	assert.False(t, ok, "too many clients")
+
+	h.close()
+	_, open = <-fast
+	assert.False(t, open, "disconnected on close")
+	_, ok = h.subscribe()
+	assert.False(t, ok, "closed hub rejects clients")
+}
+
+func TestServerStream(t *testing.T) {
+	srv := &Server{Engine: &goodDB{}, Aggregator: &store.Aggregator{}}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/stream?partial=bad")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = http.Get(ts.URL + "/api/stream?partial=1s&node=n6.radio-t.com")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	for _, body := range []string{
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:00:00Z"}`,
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","dest":"n7.radio-t.com","ts":"2024-01-01T12:00:00Z"}`,
+		`{"from_ip":"127.0.0.1","file_name":"rt_podcast561.mp3","dest":"n6.radio-t.com","ts":"2024-01-01T12:01:00Z"}`,
+	} {
+		r, err := http.Post(ts.URL+"/api/insert", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+	}
+
+	// reads the next event, skipping comments
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (event string, candle store.Candle) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			require.NoError(t, err)
+			switch {
+			case bytes.HasPrefix(line, []byte("event: ")):
+				event = strings.TrimSpace(string(line[len("event: "):]))
+			case bytes.HasPrefix(line, []byte("data: ")):
+				require.NoError(t, json.Unmarshal(line[len("data: "):], &candle))
+			case len(bytes.TrimSpace(line)) == 0 && event != "":
+				return event, candle
+			}
+		}
+	}
+
+	event, candle := readEvent()
+	assert.Equal(t, "candle", event)
+	assert.Equal(t, map[string]store.Info{"n6.radio-t.com": {Volume: 1, Files: map[string]int{}}}, candle.Nodes)
+	assert.True(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Equal(candle.StartMinute))
+
+	event, candle = readEvent()
+	assert.Equal(t, "partial", event)
+	assert.Equal(t, map[string]store.Info{"n6.radio-t.com": {Volume: 1, Files: map[string]int{}}}, candle.Nodes)
+	assert.True(t, time.Date(2024, 1, 1, 12, 1, 0, 0, time.UTC).Equal(candle.StartMinute))
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"context"
+	"time"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+// summary contains download totals for a period
+type summary struct {
+	From          time.Time      `json:"from"`
+	To            time.Time      `json:"to"`
+	Volume        int            `json:"volume"`         // downloads from all nodes
+	Nodes         map[string]int `json:"nodes"`          // downloads by node, "all" node excluded
+	Files         []fileSummary  `json:"files"`          // top files by downloads
+	DistinctNodes int            `json:"distinct_nodes"` // number of nodes with downloads, "all" node excluded
+	DistinctFiles int            `json:"distinct_files"` // number of downloaded files
+}
+
+// fileSummary contains downloads of a single file
+type fileSummary struct {
+	Name    string  `json:"name"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"` // share of the file in downloads of all files
+}
+
+// loadSummary iterates over candles of [from, to) period with the coarsest resolution both ends are aligned to,
+// and summarises them with up to filesLimit top files
+func loadSummary(ctx context.Context, engine store.Engine, from, to time.Time, filesLimit int) (summary, error) {
+	sum := newSummarizer()
+	err := engine.Iterate(ctx, from, to.Add(-time.Second), periodResolution(from, to), func(c store.Candle) error {
+		sum.add(c)
+		return nil
+	})
+	if err != nil {
+		return summary{}, err
+	}
+	res := sum.summary(filesLimit)
+	res.From, res.To = from, to
+	return res, nil
+}
+
+// periodResolution returns the coarsest stored resolution both ends of the period are aligned to
+func periodResolution(from, to time.Time) time.Duration {
+	for _, r := range rollupResolutions {
+		if from.Truncate(r).Equal(from) && to.Truncate(r).Equal(to) {
+			return r
+		}
+	}
+	return time.Minute
+}
+
+// summarizer sums up node volumes and file counts of candles added one by one
+type summarizer struct {
+	volume int
+	nodes  map[string]int
+	files  map[string]int
+}
+
+// newSummarizer makes empty summarizer
+func newSummarizer() *summarizer {
+	return &summarizer{nodes: map[string]int{}, files: map[string]int{}}
+}
+
+// add sums up node volumes and file counts of the candle
+func (s *summarizer) add(c store.Candle) {
+	for name, node := range c.Nodes {
+		if name != "all" {
+			s.nodes[name] += node.Volume
+			continue
+		}
+		s.volume += node.Volume
+		for file, count := range node.Files {
+			s.files[file] += count
+		}
+	}
+}
+
+// summary returns totals of added candles with up to filesLimit top files
+func (s *summarizer) summary(filesLimit int) summary {
+	res := summary{Volume: s.volume, Nodes: s.nodes, Files: []fileSummary{}}
+	var filesTotal int
+	for _, count := range s.files {
+		filesTotal += count
+	}
+	for _, f := range store.TopCounts(s.files, filesLimit) {
+		res.Files = append(res.Files, fileSummary{Name: f.Key, Count: f.Count, Percent: 100 * float64(f.Count) / float64(filesTotal)})
+	}
+	res.DistinctNodes = len(s.nodes)
+	res.DistinctFiles = len(s.files)
+	return res
+}
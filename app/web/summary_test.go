@@ -0,0 +1,70 @@
+package web
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb-stats/app/store"
+)
+
+func TestSummarizer(t *testing.T) {
+	candles := []store.Candle{
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 3, Files: map[string]int{}},
+			"all":            {Volume: 3, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast562.mp3": 1}},
+		}, StartMinute: time.Unix(0, 0)},
+		{Nodes: map[string]store.Info{
+			"n6.radio-t.com": {Volume: 1, Files: map[string]int{}},
+			"n7.radio-t.com": {Volume: 4, Files: map[string]int{}},
+			"all": {Volume: 5, Files: map[string]int{"/rtfiles/rt_podcast561.mp3": 2, "/rtfiles/rt_podcast562.mp3": 1,
+				"/rtfiles/rt_podcast563.mp3": 2}},
+		}, StartMinute: time.Unix(60, 0)},
+	}
+	sum := newSummarizer()
+	for _, c := range candles {
+		sum.add(c)
+	}
+
+	assert.Equal(t, summary{
+		Volume: 8,
+		Nodes:  map[string]int{"n6.radio-t.com": 4, "n7.radio-t.com": 4},
+		Files: []fileSummary{
+			{Name: "/rtfiles/rt_podcast561.mp3", Count: 4, Percent: 50},
+			{Name: "/rtfiles/rt_podcast562.mp3", Count: 2, Percent: 25},
+		},
+		DistinctNodes: 2,
+		DistinctFiles: 3,
+	}, sum.summary(2), "files with the same count ordered by name")
+
+	assert.Empty(t, sum.summary(0).Files)
+	assert.Equal(t, summary{Nodes: map[string]int{}, Files: []fileSummary{}}, newSummarizer().summary(10))
+}
+
+func TestLoadSummary(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		from, to time.Time
+		res      time.Duration
+	}{
+		{from: day, to: day.Add(7 * 24 * time.Hour), res: 24 * time.Hour},
+		{from: day.Add(time.Hour), to: day.Add(7 * 24 * time.Hour), res: time.Hour},
+		{from: day, to: day.Add(90 * time.Minute), res: time.Minute},
+		{from: day.Add(30 * time.Second), to: day.Add(time.Hour), res: time.Minute},
+	}
+	for _, tt := range tbl {
+		db := &goodDB{saved: []store.Candle{storedCandle}}
+		res, err := loadSummary(context.Background(), db, tt.from, tt.to, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []time.Duration{tt.res}, db.resolutions, "%v - %v", tt.from, tt.to)
+		assert.Equal(t, tt.from, res.From)
+		assert.Equal(t, tt.to, res.To)
+		assert.Equal(t, 1, res.Volume)
+	}
+
+	_, err := loadSummary(context.Background(), MockDB{}, day, day.Add(time.Hour), 10)
+	assert.EqualError(t, err, "test error")
+}